@@ -0,0 +1,102 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"net"
+	"strings"
+)
+
+// AccessRule allows or denies requests from a network.
+type AccessRule struct {
+	// Allow lets matching requests through.  Otherwise they are refused.
+	Allow bool
+	// Op limits the rule to OpRRQ or OpWRQ.  Zero means both.
+	Op uint16
+	// Network limits the rule to requests from these addresses.
+	// Nil means any address.
+	Network *net.IPNet
+	// Pattern limits the rule to filenames matching it, in the manner of
+	// a ServeMux pattern.  Empty means any filename.
+	Pattern string
+}
+
+// AccessList returns middleware that checks each request against rules,
+// in order, and lets the first that matches decide.  A request that no
+// rule matches is allowed, so a list restricting writes to a network is
+//
+//	[]tftp.AccessRule{
+//		{Allow: true, Op: tftp.OpWRQ, Network: lan},
+//		{Allow: false, Op: tftp.OpWRQ},
+//	}
+//
+// Refused requests are answered with an access violation, and logged to
+// OpLogger.  Filenames are checked as the handler will see them, so an
+// AccessList should follow any Remap layer.  It panics if a pattern is
+// invalid, as ServeMux does.
+func AccessList(rules []AccessRule) Middleware {
+	for _, rule := range rules {
+		if rule.Pattern != "" {
+			checkPattern(rule.Pattern)
+		}
+	}
+	// check returns ErrAccessViolation if r is refused
+	check := func(r *Request) error {
+		if allowed(rules, r) {
+			return nil
+		}
+		verb := "read"
+		if r.Op == OpWRQ {
+			verb = "write"
+		}
+		OpLogger.Printf("Access list refused %s of %s by %s", verb, r.Filename, r.RemoteAddr.String())
+		return ErrAccessViolation
+	}
+	return Middleware{
+		Read: func(next ReadHandler) ReadHandler {
+			return ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+				if err := check(r); err != nil {
+					return nil, 0, err
+				}
+				return next.ServeRead(ctx, r)
+			})
+		},
+		Write: func(next WriteHandler) WriteHandler {
+			return WriteHandlerFunc(func(ctx context.Context, r *Request) (FileWriter, error) {
+				if err := check(r); err != nil {
+					return nil, err
+				}
+				return next.ServeWrite(ctx, r)
+			})
+		},
+	}
+}
+
+// allowed reports whether the first of rules to match r allows it,
+// or true if none do.
+func allowed(rules []AccessRule, r *Request) bool {
+	ip := addrIP(r.RemoteAddr)
+	for _, rule := range rules {
+		if rule.Op != 0 && rule.Op != r.Op {
+			continue
+		}
+		if rule.Network != nil && (ip == nil || !rule.Network.Contains(ip)) {
+			continue
+		}
+		if rule.Pattern != "" && !patternMatches(rule.Pattern, r.Filename) {
+			continue
+		}
+		return rule.Allow
+	}
+	return true
+}
+
+// patternMatches reports whether filename matches pattern,
+// as a ServeMux would route it.
+func patternMatches(pattern, filename string) bool {
+	filename = strings.TrimPrefix(filename, "/")
+	if pattern != "/" {
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	return filename == pattern || matches(filename, pattern)
+}
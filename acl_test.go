@@ -0,0 +1,82 @@
+package tftp
+
+import (
+	"context"
+	"net"
+	"testing"
+)
+
+func TestAccessListRules(t *testing.T) {
+	_, lan, _ := net.ParseCIDR("10.0.0.0/8")
+	_, admin, _ := net.ParseCIDR("10.9.0.0/16")
+	rules := []AccessRule{
+		{Allow: true, Op: OpWRQ, Network: admin},
+		{Allow: true, Op: OpWRQ, Network: lan, Pattern: "uploads/"},
+		{Allow: false, Op: OpWRQ},
+		{Allow: false, Network: lan, Pattern: "secrets/*"},
+	}
+
+	inside := &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1234}
+	adminHost := &net.UDPAddr{IP: net.IPv4(10, 9, 2, 3), Port: 1234}
+	outside := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+	var tests = []struct {
+		op       uint16
+		filename string
+		addr     net.Addr
+		expected bool
+	}{
+		{OpRRQ, "pxelinux.0", outside, true},
+		{OpWRQ, "pxelinux.0", outside, false},
+		{OpWRQ, "uploads/log", outside, false},
+		{OpWRQ, "uploads/log", inside, true},
+		{OpWRQ, "/uploads/log", inside, true},
+		{OpWRQ, "pxelinux.0", inside, false},
+		{OpWRQ, "pxelinux.0", adminHost, true},
+		{OpRRQ, "secrets/key", inside, false},
+		{OpRRQ, "secrets/key", outside, true},
+		{OpRRQ, "secrets/keys/old", inside, true},
+		{OpWRQ, "pxelinux.0", nil, false},
+	}
+	for _, test := range tests {
+		r := &Request{Op: test.op, Filename: test.filename, RemoteAddr: test.addr}
+		if actual := allowed(rules, r); actual != test.expected {
+			t.Errorf("Op %d of %s from %v: expected %t, got %t", test.op, test.filename, test.addr, test.expected, actual)
+		}
+	}
+}
+
+func TestAccessListInvalidPattern(t *testing.T) {
+	defer func() {
+		if recover() == nil {
+			t.Error("Expected an invalid pattern to panic")
+		}
+	}()
+	AccessList([]AccessRule{{Pattern: "["}})
+}
+
+func TestAccessListMiddleware(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	config := newTestConfig()
+	config.Middleware = []Middleware{AccessList([]AccessRule{{Allow: false, Op: OpWRQ}})}
+	setTestData(t, config.Store, "pxelinux.0", []byte{42})
+	addr := &net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 1234}
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: "pxelinux.0"}
+	if err := handleRead(context.Background(), &testPacketConn.Server, p, addr, config, testUtils); err != nil {
+		t.Fatal(err)
+	}
+	checkErrors(callCounter, t)
+
+	p = PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "pxelinux.0"}
+	if err := handleWrite(context.Background(), &testPacketConn.Server, p, addr, config, testUtils); err != ErrAccessViolation {
+		t.Errorf("Expected ErrAccessViolation, got %v", err)
+	}
+	if calls := callCounter["sendError"]; len(calls) != 1 || calls[0]["code"] != uint16(2) {
+		t.Errorf("Expected the write to be refused with error 2, got %v", calls)
+	}
+	if calls := callCounter["receiveData"]; len(calls) != 0 {
+		t.Errorf("Expected no data to be received, got %v", calls)
+	}
+}
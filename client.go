@@ -0,0 +1,353 @@
+package tftp
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Client reads and writes files on TFTP servers.  The zero value is a
+// usable client, which transfers in octet mode without requesting options.
+type Client struct {
+	// Mode is the transfer mode, "octet" or "netascii".
+	// Empty means octet.  Get and Put refuse any other mode.
+	Mode string
+
+	// BlockSize, if set, is requested with the blksize option.  It is
+	// capped at the largest block that fits in MaxPacketSize, as larger
+	// packets couldn't be read whole.
+	BlockSize int
+
+	// WindowSize, if set, is requested with the windowsize option.
+	WindowSize int
+
+	// TransferSize requests the tsize option.  Get checks that it receives
+	// as many bytes as the server says the file holds, and Put tells the
+	// server the size of the file, if the reader it is given can report it.
+	TransferSize bool
+
+	// Timeout is how long to wait for a response before resending a packet.
+	// If set, it is also requested with the timeout option, in whole
+	// seconds.  Zero means the timeout adapts to the measured round trip
+	// time, between MinTimeout and MaxTimeout.
+	Timeout time.Duration
+
+	// MinTimeout and MaxTimeout bound the adaptive timeout.
+	// Zero means 200 milliseconds and 10 seconds respectively.
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+
+	// Retries is how many times a packet is resent before giving up.
+	// Zero means DefaultRetries.
+	Retries int
+
+	// ListenPacket opens the socket each transfer is made from.
+	// If nil, an ephemeral UDP port is used.
+	ListenPacket func() (net.PacketConn, error)
+}
+
+// Get reads filename from the server at addr, writing its contents to w.
+// If addr has no port, the standard port 69 is used.
+// If the server reports an error, it is returned as a *PacketError,
+// and if it stops responding, a *TimeoutError is returned.  If ctx is
+// done first, the server is told the transfer is cancelled, and ctx.Err()
+// is returned.
+func (c *Client) Get(ctx context.Context, addr string, filename string, w io.Writer) error {
+	if err := c.checkMode(); err != nil {
+		return err
+	}
+	conn, dest, err := c.open(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+
+	settings := c.settings()
+	request := c.request(OpRRQ, filename, 0)
+	// the server answers from a new port, with an OACK if it
+	// accepted any options, and the first block of data if not
+	success := func(p Packet) bool {
+		switch v := p.(type) {
+		case *PacketOACK:
+			return true
+		case *PacketData:
+			return v.BlockNum == 1
+		}
+		return false
+	}
+	response, from, err := sendAndWait(ctx, conn, request, settings.rto, settings.retries, success, dest)
+	if err != nil {
+		return err
+	}
+
+	// tsize counts the bytes sent, so they are counted before any
+	// netascii conversion
+	var netascii *NetasciiWriter
+	received := &countingWriter{w: w}
+	if c.isNetascii() {
+		netascii = NewNetasciiWriter(w)
+		received.w = netascii
+	}
+	var data io.Writer = received
+
+	var start Packet
+	var expected int64 = -1
+	switch v := response.(type) {
+	case *PacketOACK:
+		if settings, err = c.accept(request, v, settings); err != nil {
+			writeError(conn, 8, err.Error(), from)
+			return err
+		}
+		if tsize, ok := v.Options["tsize"]; ok {
+			expected, _ = strconv.ParseInt(tsize, 10, 64)
+		}
+		start = &PacketAck{BlockNum: 0}
+	case *PacketData:
+		// the server ignored our options, so the defaults apply
+		settings.blockSize = defaultBlockSize
+		settings.windowSize = defaultWindowSize
+		if _, err = data.Write(v.Data); err != nil {
+			writeError(conn, 3, err.Error(), from)
+			return err
+		}
+		start = &PacketAck{BlockNum: 1}
+		if len(v.Data) < settings.blockSize {
+			// the whole file fit in one block
+			conn.WriteTo(start.Serialize(), from)
+			start = nil
+		}
+	}
+
+	if start != nil {
+		if err = receiveData(ctx, conn, start, data, settings, from); err != nil {
+			return err
+		}
+	}
+	if netascii != nil {
+		if err = netascii.Close(); err != nil {
+			return err
+		}
+	}
+	if expected >= 0 && received.n != expected {
+		return fmt.Errorf("received %d bytes, but the server said the file holds %d", received.n, expected)
+	}
+	return nil
+}
+
+// Put writes the contents of r to filename on the server at addr.
+// If addr has no port, the standard port 69 is used.
+// If the server reports an error, it is returned as a *PacketError,
+// and if it stops responding, a *TimeoutError is returned.  If ctx is
+// done first, the server is told the transfer is cancelled, and ctx.Err()
+// is returned.
+func (c *Client) Put(ctx context.Context, addr string, filename string, r io.Reader) error {
+	if err := c.checkMode(); err != nil {
+		return err
+	}
+	conn, dest, err := c.open(addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+
+	var size int64 = -1
+	if !c.isNetascii() {
+		// netascii changes the size of the file on the way out
+		size = readerSize(r)
+	}
+	settings := c.settings()
+	request := c.request(OpWRQ, filename, size)
+	// the server answers from a new port, with an OACK if it
+	// accepted any options, and an ack for block 0 if not
+	success := func(p Packet) bool {
+		switch v := p.(type) {
+		case *PacketOACK:
+			return true
+		case *PacketAck:
+			return v.BlockNum == 0
+		}
+		return false
+	}
+	response, from, err := sendAndWait(ctx, conn, request, settings.rto, settings.retries, success, dest)
+	if err != nil {
+		return err
+	}
+	if oack, ok := response.(*PacketOACK); ok {
+		if settings, err = c.accept(request, oack, settings); err != nil {
+			writeError(conn, 8, err.Error(), from)
+			return err
+		}
+	}
+
+	if c.isNetascii() {
+		r = NewNetasciiReader(r)
+	}
+	return sendData(ctx, conn, r, settings, from)
+}
+
+// open resolves addr, and opens the socket for a transfer to it.
+func (c *Client) open(addr string) (net.PacketConn, net.Addr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		// an IPv6 address may be bracketed, as it would be with a port
+		if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+			addr = addr[1 : len(addr)-1]
+		}
+		addr = net.JoinHostPort(addr, "69")
+	}
+	dest, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conn net.PacketConn
+	if c.ListenPacket != nil {
+		conn, err = c.ListenPacket()
+	} else {
+		conn, err = net.ListenUDP("udp", nil)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return conn, dest, nil
+}
+
+// checkMode returns an error if Mode is not one the client supports.
+func (c *Client) checkMode() error {
+	if c.Mode == "" || strings.EqualFold(c.Mode, "octet") || c.isNetascii() {
+		return nil
+	}
+	return fmt.Errorf("unsupported mode %s", c.Mode)
+}
+
+func (c *Client) isNetascii() bool {
+	return strings.EqualFold(c.Mode, "netascii")
+}
+
+// settings returns the settings to use for a transfer before any options
+// have been negotiated.
+func (c *Client) settings() transferSettings {
+	s := negotiatedSettings(nil)
+	if c.Timeout > 0 {
+		s.rto = fixedTimer(c.Timeout)
+	} else {
+		s.rto.limit(c.MinTimeout, c.MaxTimeout)
+	}
+	s.retries = c.Retries
+	if s.retries == 0 {
+		s.retries = DefaultRetries
+	}
+	return s
+}
+
+// request builds a request for filename, with the options the client
+// has been configured to ask for.  size is the size of the file being
+// written, or -1 if it isn't known.
+func (c *Client) request(op uint16, filename string, size int64) *PacketRequest {
+	mode := "octet"
+	if c.isNetascii() {
+		mode = "netascii"
+	}
+	options := make(map[string]string)
+	if c.BlockSize > 0 {
+		size := c.BlockSize
+		if size > largestBlockSize() {
+			size = largestBlockSize()
+		}
+		options["blksize"] = strconv.Itoa(size)
+	}
+	if c.WindowSize > 0 {
+		options["windowsize"] = strconv.Itoa(c.WindowSize)
+	}
+	if c.Timeout > 0 {
+		seconds := int(c.Timeout / time.Second)
+		if seconds < minTimeout {
+			seconds = minTimeout
+		}
+		if seconds > maxTimeout {
+			seconds = maxTimeout
+		}
+		options["timeout"] = strconv.Itoa(seconds)
+	}
+	if c.TransferSize && size >= 0 {
+		options["tsize"] = strconv.FormatInt(size, 10)
+	}
+	if len(options) == 0 {
+		options = nil
+	}
+	return &PacketRequest{Op: op, Filename: filename, Mode: mode, Options: options}
+}
+
+// accept checks the options acknowledged by the server are ones the
+// client asked for, with values it can use, and returns the settings
+// for the rest of the transfer, which keep the retransmission timer
+// from those used for the request.
+func (c *Client) accept(request *PacketRequest, oack *PacketOACK, local transferSettings) (transferSettings, error) {
+	for name, value := range oack.Options {
+		requested, ok := request.Options[name]
+		if !ok {
+			return transferSettings{}, fmt.Errorf("server acknowledged option %s, which was not requested", name)
+		}
+		switch name {
+		case "blksize", "windowsize":
+			// the server may only ask for less than we requested
+			n, err := strconv.Atoi(value)
+			max, _ := strconv.Atoi(requested)
+			if err != nil || n < 1 || n > max {
+				return transferSettings{}, fmt.Errorf("server acknowledged invalid %s %s", name, value)
+			}
+			if name == "blksize" && n > largestBlockSize() {
+				// the rest of each packet would be cut off
+				return transferSettings{}, fmt.Errorf("server acknowledged blksize %s, larger than packets of %d bytes allow", value, MaxPacketSize)
+			}
+		case "timeout":
+			if value != requested {
+				return transferSettings{}, fmt.Errorf("server acknowledged invalid timeout %s", value)
+			}
+		case "tsize":
+			if n, err := strconv.ParseInt(value, 10, 64); err != nil || n < 0 {
+				return transferSettings{}, fmt.Errorf("server acknowledged invalid tsize %s", value)
+			}
+		}
+	}
+	s := negotiatedSettings(oack.Options)
+	s.rto, s.retries = local.rto, local.retries
+	return s, nil
+}
+
+// readerSize returns the number of bytes left in r,
+// or -1 if r can't tell us.
+func readerSize(r io.Reader) int64 {
+	switch v := r.(type) {
+	case interface{ Len() int }:
+		return int64(v.Len())
+	case *os.File:
+		info, err := v.Stat()
+		if err != nil || !info.Mode().IsRegular() {
+			return -1
+		}
+		offset, err := v.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return -1
+		}
+		return info.Size() - offset
+	}
+	return -1
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
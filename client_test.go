@@ -0,0 +1,355 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestClient returns a client whose transfers go through conn
+func newTestClient(conn *TestPacketConn) *Client {
+	return &Client{
+		ListenPacket: func() (net.PacketConn, error) {
+			return &conn.Client, nil
+		},
+	}
+}
+
+// readRequest reads a request from the client, as the server would
+func readRequest(t *testing.T, conn net.PacketConn) PacketRequest {
+	buf := make([]byte, 517)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := PacketRequest{}
+	if err = p.Parse(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestClientGet(t *testing.T) {
+	value := bytes.Join(generateTestData(3, 10), nil)
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+	client.TransferSize = true
+	client.WindowSize = 2
+
+	var result bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- client.Get(context.Background(), "localhost", "foo", &result)
+	}()
+
+	request := readRequest(t, &conn.Server)
+	if request.Op != OpRRQ || request.Filename != "foo" || request.Mode != "octet" {
+		t.Errorf("Unexpected request %+v", request)
+	}
+	if request.Options["tsize"] != "0" || request.Options["windowsize"] != "2" {
+		t.Errorf("Expected tsize and windowsize to be requested, got %v", request.Options)
+	}
+
+	// play the server's part
+	oack := PacketOACK{Options: map[string]string{"tsize": "1034", "windowsize": "2"}}
+	conn.Server.WriteTo(oack.Serialize(), nil)
+	if p := ReadAckPacket(t, &conn.Server); p.BlockNum != 0 {
+		t.Errorf("Expected OACK to be acked with block 0, got %d", p.BlockNum)
+	}
+	if err := sendData(context.Background(), &conn.Server, bytes.NewReader(value), testSettings(2), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Bytes(), value) {
+		t.Error("Data corruption detected.")
+	}
+}
+
+func TestClientGetWithoutOptions(t *testing.T) {
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+	client.BlockSize = 1024
+
+	var result bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- client.Get(context.Background(), "localhost:6969", "foo", &result)
+	}()
+
+	readRequest(t, &conn.Server)
+	// the server ignores blksize, and sends the whole file in one block
+	data := PacketData{BlockNum: 1, Data: []byte("fnord")}
+	conn.Server.WriteTo(data.Serialize(), nil)
+	if p := ReadAckPacket(t, &conn.Server); p.BlockNum != 1 {
+		t.Errorf("Expected ack for block 1, got %d", p.BlockNum)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if result.String() != "fnord" {
+		t.Errorf("Expected fnord, got %q", result.String())
+	}
+}
+
+func TestClientGetError(t *testing.T) {
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+
+	done := make(chan error)
+	go func() {
+		done <- client.Get(context.Background(), "localhost", "foo", &bytes.Buffer{})
+	}()
+
+	readRequest(t, &conn.Server)
+	e := PacketError{Code: 1, Msg: "File foo not found"}
+	conn.Server.WriteTo(e.Serialize(), nil)
+
+	err := <-done
+	if remote, ok := err.(*PacketError); !ok || remote.Code != 1 {
+		t.Errorf("Expected error 1 from server, got %v", err)
+	}
+}
+
+func TestClientUnknownMode(t *testing.T) {
+	client := &Client{
+		Mode: "mail",
+		ListenPacket: func() (net.PacketConn, error) {
+			t.Error("Expected nothing to be sent in an unknown mode")
+			return nil, errors.New("unreachable")
+		},
+	}
+	if err := client.Get(context.Background(), "127.0.0.1", "foo", &bytes.Buffer{}); err == nil {
+		t.Error("Expected Get to refuse mode mail")
+	}
+	if err := client.Put(context.Background(), "127.0.0.1", "foo", &bytes.Buffer{}); err == nil {
+		t.Error("Expected Put to refuse mode mail")
+	}
+}
+
+func TestClientOpen(t *testing.T) {
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+	for addr, expected := range map[string]string{
+		"127.0.0.1":      "127.0.0.1:69",
+		"127.0.0.1:6969": "127.0.0.1:6969",
+		"::1":            "[::1]:69",
+		"[::1]":          "[::1]:69",
+		"[::1]:6969":     "[::1]:6969",
+		"[fe80::1%lo]":   "[fe80::1%lo]:69",
+		"fe80::1%lo":     "[fe80::1%lo]:69",
+	} {
+		_, dest, err := client.open(addr)
+		if err != nil {
+			t.Errorf("Failed to open %s: %v", addr, err)
+		} else if dest.String() != expected {
+			t.Errorf("Expected %s to be sent to %s, got %s", addr, expected, dest.String())
+		}
+	}
+}
+
+func TestClientGetUnrequestedOption(t *testing.T) {
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+
+	done := make(chan error)
+	go func() {
+		done <- client.Get(context.Background(), "localhost", "foo", &bytes.Buffer{})
+	}()
+
+	readRequest(t, &conn.Server)
+	oack := PacketOACK{Options: map[string]string{"blksize": "1024"}}
+	conn.Server.WriteTo(oack.Serialize(), nil)
+
+	// the client should refuse the OACK with error 8
+	buf := make([]byte, 517)
+	n, _, _ := conn.Server.ReadFrom(buf)
+	p := PacketError{}
+	if err := p.Parse(buf[:n]); err != nil || p.Code != 8 {
+		t.Errorf("Expected error 8, got %+v", p)
+	}
+	if err := <-done; err == nil {
+		t.Error("Get accepted an unrequested option")
+	}
+}
+
+func TestClientBlockSizeCapped(t *testing.T) {
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+	client.BlockSize = 4096
+
+	done := make(chan error)
+	go func() {
+		done <- client.Get(context.Background(), "localhost", "foo", &bytes.Buffer{})
+	}()
+	request := readRequest(t, &conn.Server)
+	if expected := strconv.Itoa(MaxPacketSize - 4); request.Options["blksize"] != expected {
+		t.Errorf("Expected blksize to be capped at %s, got %s", expected, request.Options["blksize"])
+	}
+	e := PacketError{Code: 1, Msg: "File not found"}
+	conn.Server.WriteTo(e.Serialize(), nil)
+	<-done
+}
+
+func TestClientAcceptBlockSize(t *testing.T) {
+	client := &Client{}
+	local := testSettings(defaultWindowSize)
+	// a request made before MaxPacketSize was lowered
+	request := &PacketRequest{Options: map[string]string{"blksize": "4096"}}
+	oack := &PacketOACK{Options: map[string]string{"blksize": "4096"}}
+	if _, err := client.accept(request, oack, local); err == nil {
+		t.Error("Expected a blksize too large to read to be refused")
+	}
+	oack.Options["blksize"] = "1428"
+	if s, err := client.accept(request, oack, local); err != nil || s.blockSize != 1428 {
+		t.Errorf("Expected blksize 1428 to be accepted, got %d, %v", s.blockSize, err)
+	}
+}
+
+func TestClientPut(t *testing.T) {
+	value := bytes.Join(generateTestData(2, 10), nil)
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+	client.TransferSize = true
+	client.Timeout = 3 * time.Second
+
+	done := make(chan error)
+	go func() {
+		done <- client.Put(context.Background(), "localhost", "foo", bytes.NewReader(value))
+	}()
+
+	request := readRequest(t, &conn.Server)
+	if request.Op != OpWRQ || request.Filename != "foo" {
+		t.Errorf("Unexpected request %+v", request)
+	}
+	if request.Options["tsize"] != "522" || request.Options["timeout"] != "3" {
+		t.Errorf("Expected tsize and timeout to be requested, got %v", request.Options)
+	}
+
+	// play the server's part, accepting only the timeout
+	var result bytes.Buffer
+	oack := PacketOACK{Options: map[string]string{"timeout": "3"}}
+	if err := receiveData(context.Background(), &conn.Server, &oack, &result, testSettings(defaultWindowSize), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Bytes(), value) {
+		t.Error("Data corruption detected.")
+	}
+}
+
+func TestClientCancel(t *testing.T) {
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- client.Put(ctx, "localhost", "foo", bytes.NewReader(make([]byte, 2048)))
+	}()
+
+	readRequest(t, &conn.Server)
+	ack := PacketAck{BlockNum: 0}
+	conn.Server.WriteTo(ack.Serialize(), nil)
+	if p := ReadDataPacket(t, &conn.Server); p.BlockNum != 1 {
+		t.Errorf("Expected block 1, got %d", p.BlockNum)
+	}
+
+	// cancel while the client waits for an ack
+	cancel()
+	buf := make([]byte, 517)
+	n, _, _ := conn.Server.ReadFrom(buf)
+	p := PacketError{}
+	if err := p.Parse(buf[:n]); err != nil || p.Code != 0 {
+		t.Errorf("Expected the server to be told of the cancellation, got %v", buf[:n])
+	}
+	if err := <-done; err != context.Canceled {
+		t.Errorf("Expected the transfer to be cancelled, got %v", err)
+	}
+	if _, _, err := conn.Server.ReadFrom(buf); err == nil {
+		t.Error("Expected the client to close its socket")
+	}
+}
+
+func TestClientGetNetasciiTransferSize(t *testing.T) {
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+	client.Mode = "netascii"
+	client.TransferSize = true
+
+	var result bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- client.Get(context.Background(), "localhost", "foo", &result)
+	}()
+	readRequest(t, &conn.Server)
+
+	// tsize is the size sent, before the line endings are converted
+	wire := []byte("one\r\ntwo\r\n")
+	oack := PacketOACK{Options: map[string]string{"tsize": strconv.Itoa(len(wire))}}
+	conn.Server.WriteTo(oack.Serialize(), nil)
+	ReadAckPacket(t, &conn.Server)
+	if err := sendData(context.Background(), &conn.Server, bytes.NewReader(wire), testSettings(1), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if result.String() != "one\ntwo\n" {
+		t.Errorf("Expected line endings to be converted, got %q", result.String())
+	}
+}
+
+func TestClientUnknownTID(t *testing.T) {
+	value := bytes.Join(generateTestData(2, 10), nil)
+	conn := NewPacketConn()
+	client := newTestClient(&conn)
+
+	var result bytes.Buffer
+	done := make(chan error)
+	go func() {
+		done <- client.Get(context.Background(), "localhost", "foo", &result)
+	}()
+	readRequest(t, &conn.Server)
+
+	// the server answers from a port of its own, which the client adopts
+	conn.Server.Addr = &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3000}
+	data := PacketData{BlockNum: 1, Data: value[:512]}
+	conn.Server.WriteTo(data.Serialize(), nil)
+	if p := ReadAckPacket(t, &conn.Server); p.BlockNum != 1 {
+		t.Errorf("Expected block 1 to be acked, got %d", p.BlockNum)
+	}
+
+	// a stranger can't inject the rest of the file
+	forged := PacketData{BlockNum: 2, Data: []byte("forged")}
+	conn.Server.WriteFrom(forged.Serialize(), &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3001})
+	buf := make([]byte, 517)
+	n, _, err := conn.Server.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := ParsePacket(buf[:n]); p == nil || p.(*PacketError).Code != 5 {
+		t.Errorf("Expected error 5 for the stranger, got %+v", p)
+	}
+
+	data = PacketData{BlockNum: 2, Data: value[512:]}
+	conn.Server.WriteTo(data.Serialize(), nil)
+	ReadAckPacket(t, &conn.Server)
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Bytes(), value) {
+		t.Error("Expected the file to be received from the server alone")
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+
+	"github.com/therealmitchconnors/tftp"
+)
+
+// Exit codes.  A TFTP error from the server exits with
+// exitRemoteError plus the error code it sent.
+const (
+	exitFailure     = 1
+	exitUsage       = 2
+	exitRemoteError = 10
+)
+
+func usage() {
+	fmt.Fprintf(flag.CommandLine.Output(), `Usage:
+  tftp [options] get host[:port] remote-file [local-file]
+  tftp [options] put host[:port] local-file [remote-file]
+
+The local file defaults to the name of the remote file, and "-" means
+standard output or input.  The port defaults to 69.  An IPv6 host is
+written in brackets, as in [::1]:69.
+
+Exits with status 1 if the transfer fails, 2 for bad usage, and 10 plus
+the error code if the server sends an error, so 11 means file not found.
+
+Options:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	mode := flag.String("mode", "octet", "The transfer mode, octet or netascii")
+	blockSize := flag.Int("blksize", 0, "Request this block size with the blksize option")
+	windowSize := flag.Int("windowsize", 0, "Request this many blocks per ack with the windowsize option")
+	transferSize := flag.Bool("tsize", false, "Exchange the size of the file with the tsize option")
+	timeout := flag.Duration("timeout", 0, "How long to wait before resending a packet.  Also requested with the timeout option, in whole seconds.  Zero means the timeout adapts to the network.")
+	minTimeout := flag.Duration("min-timeout", 0, "The shortest adaptive timeout.  Zero means 200ms.")
+	maxTimeout := flag.Duration("max-timeout", 0, "The longest adaptive timeout.  Zero means 10s.")
+	retries := flag.Int("retries", tftp.DefaultRetries, "How many times to resend a packet before giving up")
+	verbose := flag.Bool("v", false, "Trace every packet sent and received on standard error")
+	flag.Usage = usage
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 3 || len(args) > 4 || (args[0] != "get" && args[0] != "put") {
+		usage()
+		os.Exit(exitUsage)
+	}
+	if !strings.EqualFold(*mode, "octet") && !strings.EqualFold(*mode, "netascii") {
+		fmt.Fprintf(os.Stderr, "tftp: unknown mode %s\n", *mode)
+		os.Exit(exitUsage)
+	}
+	command, addr := args[0], args[1]
+	remote, local := args[2], path.Base(args[2])
+	if command == "put" {
+		remote, local = path.Base(args[2]), args[2]
+	}
+	if len(args) == 4 {
+		if command == "get" {
+			local = args[3]
+		} else {
+			remote = args[3]
+		}
+	}
+
+	client := &tftp.Client{
+		Mode:         *mode,
+		BlockSize:    *blockSize,
+		WindowSize:   *windowSize,
+		TransferSize: *transferSize,
+		Timeout:      *timeout,
+		MinTimeout:   *minTimeout,
+		MaxTimeout:   *maxTimeout,
+		Retries:      *retries,
+	}
+	// the library logs its progress, which is only of interest to its developers
+	log.SetOutput(ioutil.Discard)
+	tftp.OpLogger.SetOutput(ioutil.Discard)
+	if *verbose {
+		tftp.OpLogger.SetOutput(os.Stderr)
+		client.ListenPacket = func() (net.PacketConn, error) {
+			conn, err := net.ListenUDP("udp", nil)
+			if err != nil {
+				return nil, err
+			}
+			return &tftp.PacketConnLogger{PacketConn: conn}, nil
+		}
+	}
+
+	// stop the transfer cleanly on ^C
+	ctx, cancel := context.WithCancel(context.Background())
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		cancel()
+	}()
+
+	var err error
+	if command == "get" {
+		err = get(ctx, client, addr, remote, local)
+	} else {
+		err = put(ctx, client, addr, remote, local)
+	}
+	cancel()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "tftp: %s\n", err.Error())
+		if remote, ok := err.(*tftp.PacketError); ok {
+			os.Exit(exitRemoteError + int(remote.Code))
+		}
+		os.Exit(exitFailure)
+	}
+}
+
+// get reads remote into the file local, which is removed if the transfer fails.
+func get(ctx context.Context, client *tftp.Client, addr, remote, local string) error {
+	if local == "-" {
+		return client.Get(ctx, addr, remote, os.Stdout)
+	}
+	f, err := os.Create(local)
+	if err != nil {
+		return err
+	}
+	err = client.Get(ctx, addr, remote, f)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(local)
+	}
+	return err
+}
+
+// put writes the file local to remote.
+func put(ctx context.Context, client *tftp.Client, addr, remote, local string) error {
+	var r io.Reader = os.Stdin
+	if local != "-" {
+		f, err := os.Open(local)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+	return client.Put(ctx, addr, remote, r)
+}
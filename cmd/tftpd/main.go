@@ -1,11 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
+	"fmt"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/therealmitchconnors/tftp"
 )
@@ -15,7 +21,7 @@ type uInt16Value struct {
 }
 
 func (v *uInt16Value) String() string {
-	return string(v.val)
+	return strconv.FormatUint(uint64(v.val), 10)
 }
 
 func (v *uInt16Value) Set(s string) error {
@@ -27,47 +33,197 @@ func (v *uInt16Value) Set(s string) error {
 	}
 }
 
+// parseNetworks parses a comma separated list of CIDR blocks,
+// where a bare IP address stands for a block of its own.
+func parseNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if !strings.Contains(field, "/") {
+			if ip := net.ParseIP(field); ip.To4() != nil {
+				field += "/32"
+			} else {
+				field += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(field)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// parsePortRange parses a range of ports, such as 4000:4100.
+func parsePortRange(s string) (min, max int, err error) {
+	bounds := strings.SplitN(s, ":", 2)
+	if len(bounds) != 2 {
+		return 0, 0, fmt.Errorf("invalid port range %s, expected min:max", s)
+	}
+	if min, err = strconv.Atoi(bounds[0]); err != nil {
+		return 0, 0, err
+	}
+	if max, err = strconv.Atoi(bounds[1]); err != nil {
+		return 0, 0, err
+	}
+	if min < 1 || max > 65535 || max < min {
+		return 0, 0, fmt.Errorf("invalid port range %s", s)
+	}
+	return min, max, nil
+}
+
+// accessRules allows op from networks, and refuses it from anywhere else.
+func accessRules(op uint16, networks string) []tftp.AccessRule {
+	allowed, err := parseNetworks(networks)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var rules []tftp.AccessRule
+	for _, network := range allowed {
+		rules = append(rules, tftp.AccessRule{Allow: true, Op: op, Network: network})
+	}
+	return append(rules, tftp.AccessRule{Allow: false, Op: op})
+}
+
 func main() {
 	// port number defaults to 69
 	portFlag := uInt16Value{69}
 	flag.Var(&portFlag, "port", "The port tftpd will listen on")
 
+	addresses := flag.String("address", "", "Listen on these addresses, a comma separated list such as 192.0.2.1,2001:db8::1.  0.0.0.0 and :: mean every address of one family.  Empty means every address, IPv4 and IPv6.")
+
 	// maxPacketSize defaults to 2048
 	maxPacketSizeFlag := uInt16Value{uint16(tftp.MaxPacketSize)}
-	flag.Var(&maxPacketSizeFlag, "max-packet-size", "The max transmission unit for UDP reads.  Larger packets will truncate, smaller values are more efficient.")
+	flag.Var(&maxPacketSizeFlag, "max-packet-size", "The max transmission unit for UDP reads.  Larger packets will truncate, smaller values are more efficient.  Also caps the negotiated blksize.")
+
+	maxFileSize := flag.Int64("max-file-size", 0, "The largest file, in bytes, a client may declare with the tsize option when writing.  Zero means no limit.")
+
+	maxWindowSize := flag.Int("max-window-size", tftp.DefaultMaxWindowSize, "The largest windowsize to accept, as each transfer holds a window of blocks in memory.  Clients asking for more are offered this.")
+
+	netasciiCanonical := flag.Bool("netascii-canonical", false, "Store files written in netascii mode as sent, instead of converting them to local text.")
+
+	root := flag.String("root", "", "Serve files from this directory, instead of keeping them in memory.  Clients cannot reach files outside it.")
+
+	retries := flag.Int("retries", tftp.DefaultRetries, "How many times to resend a packet to a client that has stopped responding, before abandoning the transfer")
+
+	minTimeout := flag.Duration("min-timeout", 0, "The shortest time to wait before resending a packet, as the timeout adapts to the network.  Zero means 200ms.")
+	maxTimeout := flag.Duration("max-timeout", 0, "The longest time to wait before resending a packet, as the timeout adapts to the network.  Zero means 10s.")
+
+	remapFile := flag.String("remap", "", "Rewrite or refuse requested filenames with the regex rules in this file, in the manner of tftpd-hpa's -m")
+
+	readOnly := flag.Bool("read-only", false, "Refuse every write request")
+	readFrom := flag.String("read-from", "", "Only allow reads from these networks, a comma separated list of CIDR blocks or addresses")
+	writeFrom := flag.String("write-from", "", "Only allow writes from these networks, a comma separated list of CIDR blocks or addresses")
+
+	maxTransfers := flag.Int("max-transfers", 0, "The most transfers to run at once.  Further requests are refused until one ends.  Zero means no limit.")
+	maxClientTransfers := flag.Int("max-client-transfers", 0, "The most transfers to run at once for any one client address.  Zero means no limit.")
+	requestRate := flag.Float64("request-rate", 0, "The most new requests to accept each second.  Zero means no limit.")
+	clientRequestRate := flag.Float64("client-request-rate", 0, "The most new requests to accept each second from any one client address.  Zero means no limit.")
+	bandwidth := flag.Int64("bandwidth", 0, "The most bytes a second to send or receive in each transfer.  Zero means no limit.")
+
+	singlePort := flag.Bool("single-port", false, "Send every transfer from the listening port, telling clients apart by their address, for networks where only that port is reachable")
+	portRange := flag.String("port-range", "", "Send transfers from a port in this range, such as 4000:4100, instead of any free port")
 
 	opLogFile := flag.String("oplog", "./operations.log", "The destination for operation logs")
 
+	shutdownTimeout := flag.Duration("shutdown-timeout", 30*time.Second, "How long to wait for active transfers to finish after an interrupt, before cancelling them")
+
 	flag.Parse()
 
 	tftp.MaxPacketSize = int(maxPacketSizeFlag.val)
+	server := &tftp.Server{
+		ServerConfig: tftp.ServerConfig{
+			Store:             tftp.NewMapDataStore(),
+			MaxFileSize:       *maxFileSize,
+			MaxWindowSize:     *maxWindowSize,
+			NetasciiCanonical: *netasciiCanonical,
+			Retries:           *retries,
+			MinTimeout:        *minTimeout,
+			MaxTimeout:        *maxTimeout,
+		},
+		Limits: tftp.Limits{
+			MaxTransfers:       *maxTransfers,
+			MaxClientTransfers: *maxClientTransfers,
+			RequestRate:        *requestRate,
+			ClientRequestRate:  *clientRequestRate,
+		},
+		SinglePort: *singlePort,
+	}
+	if *portRange != "" {
+		min, max, err := parsePortRange(*portRange)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.MinPort, server.MaxPort = min, max
+	}
+	if *root != "" {
+		fileStore, err := tftp.NewFileDataStore(*root)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Store = fileStore
+	}
+	if *remapFile != "" {
+		rules, err := tftp.LoadRemapRules(*remapFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.Middleware = append(server.Middleware, tftp.Remap(rules))
+	}
+	var rules []tftp.AccessRule
+	if *readOnly {
+		rules = append(rules, tftp.AccessRule{Allow: false, Op: tftp.OpWRQ})
+	}
+	if *readFrom != "" {
+		rules = append(rules, accessRules(tftp.OpRRQ, *readFrom)...)
+	}
+	if *writeFrom != "" {
+		rules = append(rules, accessRules(tftp.OpWRQ, *writeFrom)...)
+	}
+	if len(rules) > 0 {
+		server.Middleware = append(server.Middleware, tftp.AccessList(rules))
+	}
+	if *bandwidth > 0 {
+		server.Middleware = append(server.Middleware, tftp.Throttle(*bandwidth))
+	}
 	f, err := os.OpenFile(*opLogFile, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
-	tftp.OpLogger.SetOutput(f)
-	log.Printf("tftpd is listening on port %d\n", portFlag.val)
-
-	ser, err := net.ListenUDP("udp", &net.UDPAddr{Port: int(portFlag.val)})
-
-	// wrap our server in the operations logger for debugging
-	// ser := &tftp.PacketConnLogger{PacketConn: udpser}
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer ser.Close()
-	for {
-		// Wait for a connection.
-		buf := make([]byte, maxPacketSizeFlag.val)
-		_, addr, err := ser.ReadFrom(buf)
-		if err != nil {
-			log.Fatal(err)
+	tftp.OpLogger.SetOutput(f)
+
+	// finish active transfers on ^C or SIGTERM
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan struct{})
+	go func() {
+		<-stop
+		log.Printf("tftpd is shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Cancelled transfers still active after %s", shutdownTimeout.String())
 		}
-		// Handle the request in go routine, allowing
-		// the main thread to keep accepting new connections.
+		close(stopped)
+	}()
 
-		// Stale clients will cause stale go routines,
-		// but we can handle millions of go routines in an app,
-		// so this is likely a tolerable trade-off
+	hosts := []string{""}
+	if *addresses != "" {
+		hosts = strings.Split(*addresses, ",")
+	}
+	served := make(chan error, len(hosts))
+	for _, host := range hosts {
+		addr := net.JoinHostPort(strings.Trim(strings.TrimSpace(host), "[]"), strconv.Itoa(int(portFlag.val)))
+		log.Printf("tftpd is listening on %s\n", addr)
 		go func() {
-			tftp.HandleReq(buf, *addr.(*net.UDPAddr))
+			served <- server.ListenAndServe(addr)
 		}()
 	}
+	for range hosts {
+		if err := <-served; err != tftp.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}
+	<-stopped
 }
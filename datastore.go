@@ -1,18 +1,52 @@
 package tftp
 
-import "sync"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
 
-type datastore interface {
-	keyExists(key string) bool
-	getData(key string) [][]byte
-	setData(key string, value [][]byte)
+var (
+	// ErrNotFound is returned by a Datastore asked for a file it doesn't have.
+	ErrNotFound = errors.New("file not found")
+	// ErrAccessViolation is returned by a Datastore asked for a file
+	// the client isn't allowed to read or write.
+	ErrAccessViolation = errors.New("access violation")
+)
+
+// Datastore is the backend files are read from and written to.
+// Files are streamed in both directions, so a transfer only ever holds
+// a window of blocks in memory, whatever the size of the file.
+// Implementations must be safe for concurrent use, as every
+// transfer runs in its own goroutine.
+type Datastore interface {
+	// Open returns a reader for the contents of the file named key,
+	// along with its size in bytes, or -1 if the size isn't known.
+	// It returns ErrNotFound if there is no such file.
+	Open(ctx context.Context, key string) (io.ReadCloser, int64, error)
+	// Create returns a writer that replaces the contents of the file
+	// named key.  It should fail straight away if the file can't be
+	// written, before the client sends any data.
+	Create(ctx context.Context, key string) (FileWriter, error)
+}
+
+// FileWriter receives the contents of a file as it is written.
+// Nothing written is visible to readers until Commit is called, and
+// Abort discards it all, so a failed transfer never leaves a partial
+// file behind.  Exactly one of Commit or Abort must be called.
+type FileWriter interface {
+	io.Writer
+	Commit() error
+	Abort() error
 }
 
-// MapDataStore will allow us to move to diverse
-// backends for tftp.  This implementation stores
-// in memory.
+// MapDataStore is a Datastore that keeps everything in memory.
+// The zero value is an empty store, ready to use.
 type MapDataStore struct {
-	mapStore map[string][][]byte
+	mapStore map[string][]byte
 	lock     sync.RWMutex
 }
 
@@ -20,26 +54,50 @@ type MapDataStore struct {
 // map on write.
 // https://github.com/orcaman/concurrent-map
 // may be a performance improvement.
-// var lock = sync.RWMutex{}
 
-func (m *MapDataStore) keyExists(key string) bool {
-	m.lock.RLock()
-	defer m.lock.RUnlock()
-	_, ok := m.mapStore[key]
-	return ok
+// NewMapDataStore returns an empty MapDataStore.
+func NewMapDataStore() *MapDataStore {
+	return &MapDataStore{mapStore: make(map[string][]byte)}
 }
 
-// TODO: move this to interface for dependency injection
-func (m *MapDataStore) getData(key string) [][]byte {
-	// here we need a thread-safe map of string to 2d
-	// array of bytes, whose shape is n x 512
+func (m *MapDataStore) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	return m.mapStore[key]
+	value, ok := m.mapStore[key]
+	if !ok {
+		return nil, 0, ErrNotFound
+	}
+	// values are never modified once stored, only replaced,
+	// so it's safe to read this one after unlocking
+	return ioutil.NopCloser(bytes.NewReader(value)), int64(len(value)), nil
+}
+
+func (m *MapDataStore) Create(ctx context.Context, key string) (FileWriter, error) {
+	return &mapFileWriter{store: m, key: key}, nil
 }
 
-func (m *MapDataStore) setData(key string, value [][]byte) {
+func (m *MapDataStore) set(key string, value []byte) {
 	m.lock.Lock()
 	defer m.lock.Unlock()
+	if m.mapStore == nil {
+		m.mapStore = make(map[string][]byte)
+	}
 	m.mapStore[key] = value
 }
+
+// mapFileWriter buffers a file until it can be stored in a MapDataStore.
+type mapFileWriter struct {
+	bytes.Buffer
+	store *MapDataStore
+	key   string
+}
+
+func (w *mapFileWriter) Commit() error {
+	w.store.set(w.key, w.Bytes())
+	return nil
+}
+
+func (w *mapFileWriter) Abort() error {
+	w.Reset()
+	return nil
+}
@@ -1,35 +1,78 @@
 package tftp
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"testing"
+)
 
-func TestSetData(t *testing.T) {
-	m := MapDataStore{mapStore: make(map[string][][]byte)}
-	value := make([][]byte, 10)
-	var cur byte
-	for i := 0; i < 10; i++ {
-		value[i] = make([]byte, 512)
-		for j := 0; j < 512; j++ {
-			value[i][j] = cur
-			cur++
-		}
+// setTestData writes a whole file to store, failing the test if it can't
+func setTestData(t *testing.T, store Datastore, key string, value []byte) {
+	w, err := store.Create(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
 	}
-	key := "fhqwgads"
-	m.setData(key, value)
-	if !m.keyExists(key) {
-		t.Error("key fhqwgads was set, exists returns false")
+	if _, err = w.Write(value); err != nil {
+		t.Fatal(err)
 	}
-	value2 := m.getData(key)
+	if err = w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// getTestData reads a whole file from store, failing the test if it's missing
+func getTestData(t *testing.T, store Datastore, key string) []byte {
+	r, size, err := store.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	value, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size >= 0 && size != int64(len(value)) {
+		t.Errorf("Open reported size %d, but read %d bytes", size, len(value))
+	}
+	return value
+}
+
+func TestSetData(t *testing.T) {
+	m := NewMapDataStore()
+	value := bytes.Join(generateTestData(10, 0), nil)
+	key := "fhqwgads"
+	setTestData(t, m, key, value)
+	value2 := getTestData(t, m, key)
 	if len(value) != len(value2) {
 		t.Errorf("We gave an array of len %d but got back an array of len %d", len(value), len(value2))
 	}
-	if len(value[0]) != len(value2[0]) {
-		t.Errorf("Input array and 2nd dimension of %d while output array had %d", len(value[0]), len(value2[0]))
-	}
 	for i := range value {
-		for j := range value[i] {
-			if value[i][j] != value2[i][j] {
-				t.Errorf("input array [%d][%d] had value %d, while output array had %d", i, j, value[i][j], value2[i][j])
-			}
+		if value[i] != value2[i] {
+			t.Errorf("input array [%d] had value %d, while output array had %d", i, value[i], value2[i])
 		}
 	}
 }
+
+func TestGetMissingData(t *testing.T) {
+	var m MapDataStore
+	if _, _, err := m.Open(context.Background(), "fhqwgads"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound for missing key, got %v", err)
+	}
+}
+
+func TestAbortData(t *testing.T) {
+	m := NewMapDataStore()
+	w, err := m.Create(context.Background(), "fhqwgads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte{42})
+	if _, _, err = m.Open(context.Background(), "fhqwgads"); err != ErrNotFound {
+		t.Errorf("Uncommitted data was visible: %v", err)
+	}
+	w.Abort()
+	if _, _, err = m.Open(context.Background(), "fhqwgads"); err != ErrNotFound {
+		t.Errorf("Aborted data was stored: %v", err)
+	}
+}
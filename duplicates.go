@@ -0,0 +1,73 @@
+package tftp
+
+import (
+	"sync"
+	"time"
+)
+
+// duplicateWindow is how long a request is still recognised after its
+// transfer ends, in case a retransmission of it was delayed.
+const duplicateWindow = 2 * time.Second
+
+// requestKey identifies a request, as a client retransmits it.
+type requestKey struct {
+	addr     string
+	op       uint16
+	filename string
+}
+
+// duplicates recognises requests a client has retransmitted, because the
+// first packet of the transfer was lost or slow, so they don't start a
+// second transfer the client doesn't know the port of.
+type duplicates struct {
+	mu sync.Mutex
+	// requests holds, for each request seen, when it may be forgotten,
+	// or the zero time while its transfer is in progress
+	requests  map[requestKey]time.Time
+	nextSweep time.Time
+}
+
+// start records the request key, and reports whether it is new, rather
+// than one in progress or recently ended.  Each new request must be ended.
+func (d *duplicates) start(key requestKey, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.requests == nil {
+		d.requests = make(map[requestKey]time.Time)
+	}
+	if now.After(d.nextSweep) {
+		d.sweep(now)
+		d.nextSweep = now.Add(duplicateWindow)
+	}
+	if expires, ok := d.requests[key]; ok && (expires.IsZero() || now.Before(expires)) {
+		return false
+	}
+	d.requests[key] = time.Time{}
+	return true
+}
+
+// end records that the transfer for key is over, so that duplicates are
+// only recognised for a little while longer.
+func (d *duplicates) end(key requestKey, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests[key] = now.Add(duplicateWindow)
+}
+
+// forget drops key at once, as for a request that was refused, so that
+// the client can repeat it if it didn't hear why.
+func (d *duplicates) forget(key requestKey) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.requests, key)
+}
+
+// sweep forgets the requests that have expired.
+// The caller must hold d.mu.
+func (d *duplicates) sweep(now time.Time) {
+	for key, expires := range d.requests {
+		if !expires.IsZero() && !now.Before(expires) {
+			delete(d.requests, key)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package tftp
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDuplicates(t *testing.T) {
+	var d duplicates
+	now := time.Now()
+	key := requestKey{addr: "10.0.0.1:1234", op: OpRRQ, filename: "foo"}
+	if !d.start(key, now) {
+		t.Fatal("Expected the first request to be new")
+	}
+	if d.start(key, now.Add(time.Minute)) {
+		t.Error("Expected a request in progress to be a duplicate")
+	}
+	for _, other := range []requestKey{
+		{addr: "10.0.0.1:1235", op: OpRRQ, filename: "foo"},
+		{addr: "10.0.0.1:1234", op: OpWRQ, filename: "foo"},
+		{addr: "10.0.0.1:1234", op: OpRRQ, filename: "bar"},
+	} {
+		if !d.start(other, now) {
+			t.Errorf("Expected %+v to be new", other)
+		}
+	}
+
+	d.end(key, now.Add(time.Minute))
+	if d.start(key, now.Add(time.Minute+duplicateWindow/2)) {
+		t.Error("Expected a request that just ended to be a duplicate")
+	}
+	if !d.start(key, now.Add(time.Minute+duplicateWindow)) {
+		t.Error("Expected a request to be new once the window has passed")
+	}
+
+	d.forget(key)
+	if !d.start(key, now.Add(time.Minute+duplicateWindow)) {
+		t.Error("Expected a forgotten request to be new")
+	}
+}
+
+func TestDuplicatesSweep(t *testing.T) {
+	var d duplicates
+	now := time.Now()
+	done := requestKey{addr: "10.0.0.1:1234", op: OpRRQ, filename: "done"}
+	active := requestKey{addr: "10.0.0.1:1234", op: OpRRQ, filename: "active"}
+	d.start(done, now)
+	d.start(active, now)
+	d.end(done, now)
+	d.start(requestKey{}, now.Add(2*duplicateWindow))
+	if _, ok := d.requests[done]; ok {
+		t.Error("Expected an expired request to be swept")
+	}
+	if _, ok := d.requests[active]; !ok {
+		t.Error("Expected a request in progress to be kept")
+	}
+}
+
+func TestServeIgnoresDuplicates(t *testing.T) {
+	conn := NewPacketConn()
+	release := make(chan struct{})
+	s, started := newTestServer(func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	go s.Serve(&conn.Server)
+	defer s.Shutdown(context.Background())
+
+	request := PacketRequest{Op: OpRRQ, Filename: "foo", Mode: "octet"}
+	conn.Client.WriteTo(request.Serialize(), nil)
+	<-started
+	conn.Client.WriteTo(request.Serialize(), nil)
+
+	other := PacketRequest{Op: OpRRQ, Filename: "bar", Mode: "octet"}
+	conn.Client.WriteTo(other.Serialize(), nil)
+	if p := <-started; p.Filename != "bar" {
+		t.Errorf("Expected the duplicate to be ignored, and bar to start, got %+v", p)
+	}
+	close(release)
+}
+
+func TestServeForgetsAbortedRequests(t *testing.T) {
+	conn := NewPacketConn()
+	s, started := newTestServer(func(ctx context.Context) error {
+		// the client gave up on the transfer
+		return &PacketError{Code: 0, Msg: "cancelled", fromPeer: true}
+	})
+	go s.Serve(&conn.Server)
+	defer s.Shutdown(context.Background())
+
+	request := PacketRequest{Op: OpRRQ, Filename: "foo", Mode: "octet"}
+	conn.Client.WriteTo(request.Serialize(), nil)
+	<-started
+
+	// a fresh request for the same file starts a new transfer,
+	// well before the duplicate window would have passed
+	deadline := time.After(duplicateWindow / 2)
+	for {
+		conn.Client.WriteTo(request.Serialize(), nil)
+		select {
+		case <-started:
+			return
+		case <-deadline:
+			t.Fatal("Expected the request to be forgotten once the client aborted")
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestServeRemembersRefusedRequests(t *testing.T) {
+	conn := NewPacketConn()
+	s, started := newTestServer(func(ctx context.Context) error {
+		// a handler refused the request, which the client may not hear
+		return &PacketError{Code: 6, Msg: "File already exists"}
+	})
+	go s.Serve(&conn.Server)
+	defer s.Shutdown(context.Background())
+
+	request := PacketRequest{Op: OpWRQ, Filename: "foo", Mode: "octet"}
+	conn.Client.WriteTo(request.Serialize(), nil)
+	<-started
+	time.Sleep(10 * time.Millisecond)
+	conn.Client.WriteTo(request.Serialize(), nil)
+
+	other := PacketRequest{Op: OpWRQ, Filename: "bar", Mode: "octet"}
+	conn.Client.WriteTo(other.Serialize(), nil)
+	if p := <-started; p.Filename != "bar" {
+		t.Errorf("Expected the retransmission to be ignored, and bar to start, got %+v", p)
+	}
+}
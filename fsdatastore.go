@@ -0,0 +1,172 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// FileDataStore is a Datastore that serves a directory tree, like the -s
+// flag of tftpd-hpa.  Filenames are resolved relative to the root
+// directory, and may not escape it, whether by "..", an absolute path,
+// or a symlink pointing outside the root.
+type FileDataStore struct {
+	root string
+}
+
+// NewFileDataStore returns a FileDataStore serving the directory root.
+func NewFileDataStore(root string) (*FileDataStore, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	// resolve the root itself, so resolved paths can be compared with it
+	if root, err = filepath.EvalSymlinks(root); err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: root, Err: os.ErrInvalid}
+	}
+	return &FileDataStore{root: root}, nil
+}
+
+// path returns the path of the file named key under the root,
+// without following any symlinks.
+func (f *FileDataStore) path(key string) (string, error) {
+	name := filepath.FromSlash(key)
+	if key == "" || strings.HasPrefix(key, "/") || filepath.IsAbs(name) {
+		return "", ErrAccessViolation
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == ".." {
+			return "", ErrAccessViolation
+		}
+	}
+	return filepath.Join(f.root, name), nil
+}
+
+// within reports whether the resolved path lies under the root.
+func (f *FileDataStore) within(resolved string) bool {
+	rel, err := filepath.Rel(f.root, resolved)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolve follows any symlinks in path, and checks the result is still
+// under the root.  A path that doesn't exist yields ErrNotFound.
+func (f *FileDataStore) resolve(path string) (string, error) {
+	resolved, err := filepath.EvalSymlinks(path)
+	if os.IsNotExist(err) {
+		return "", ErrNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !f.within(resolved) {
+		return "", ErrAccessViolation
+	}
+	return resolved, nil
+}
+
+func (f *FileDataStore) Open(ctx context.Context, key string) (io.ReadCloser, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	path, err := f.path(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	if path, err = f.resolve(path); err != nil {
+		return nil, 0, err
+	}
+	file, err := os.Open(path)
+	if os.IsPermission(err) {
+		return nil, 0, ErrAccessViolation
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil || !info.Mode().IsRegular() {
+		file.Close()
+		return nil, 0, ErrNotFound
+	}
+	return file, info.Size(), nil
+}
+
+// writePath returns the resolved path a write to key should be renamed to.
+// It checks that key names a file that may be written under the root,
+// in a directory that already exists.
+func (f *FileDataStore) writePath(key string) (string, error) {
+	path, err := f.path(key)
+	if err != nil {
+		return "", err
+	}
+	dir, err := f.resolve(filepath.Dir(path))
+	if err != nil {
+		return "", err
+	}
+	path = filepath.Join(dir, filepath.Base(path))
+	// an existing symlink must not lead out of the root either
+	if _, err = f.resolve(path); err != nil && err != ErrNotFound {
+		return "", err
+	}
+	return path, nil
+}
+
+// Create writes to a temporary file next to the destination, which is
+// renamed into place on Commit, once the whole file has been received.
+func (f *FileDataStore) Create(ctx context.Context, key string) (FileWriter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	path, err := f.writePath(key)
+	if err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".tftp-")
+	if os.IsPermission(err) {
+		return nil, ErrAccessViolation
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &fileWriter{file: tmp, path: path}, nil
+}
+
+// fileWriter is a temporary file, destined to be renamed to path.
+type fileWriter struct {
+	file *os.File
+	path string
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *fileWriter) Commit() (err error) {
+	defer func() {
+		if err != nil {
+			os.Remove(w.file.Name())
+		}
+	}()
+	if err = w.file.Chmod(0644); err != nil {
+		w.file.Close()
+		return err
+	}
+	if err = w.file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(w.file.Name(), w.path)
+}
+
+func (w *fileWriter) Abort() error {
+	w.file.Close()
+	return os.Remove(w.file.Name())
+}
@@ -0,0 +1,131 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestFileDataStore returns a store rooted in a new temporary directory,
+// along with a function that removes it.
+func newTestFileDataStore(t *testing.T) (*FileDataStore, string, func()) {
+	dir, err := ioutil.TempDir("", "tftp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := filepath.Join(dir, "root")
+	if err = os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	f, err := NewFileDataStore(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, dir, func() { os.RemoveAll(dir) }
+}
+
+func TestFileDataStoreRoundTrip(t *testing.T) {
+	f, dir, cleanup := newTestFileDataStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	value := bytes.Join(generateTestData(3, 10), nil)
+	setTestData(t, f, "fhqwgads", value)
+	if !bytes.Equal(value, getTestData(t, f, "fhqwgads")) {
+		t.Error("input data does not match stored data.")
+	}
+
+	// an aborted write leaves the old contents in place
+	w, err := f.Create(ctx, "fhqwgads")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("partial"))
+	if err = w.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(value, getTestData(t, f, "fhqwgads")) {
+		t.Error("aborted write replaced stored data.")
+	}
+
+	// only the file itself should be left in the directory
+	entries, err := ioutil.ReadDir(filepath.Join(dir, "root"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the stored file, found %d entries", len(entries))
+	}
+}
+
+func TestFileDataStoreMissing(t *testing.T) {
+	f, _, cleanup := newTestFileDataStore(t)
+	defer cleanup()
+
+	if _, _, err := f.Open(context.Background(), "nope"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if _, err := f.Create(context.Background(), "nodir/nope"); err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound writing to a missing directory, got %v", err)
+	}
+}
+
+func TestFileDataStoreJail(t *testing.T) {
+	f, dir, cleanup := newTestFileDataStore(t)
+	defer cleanup()
+	ctx := context.Background()
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(dir, "secret"), filepath.Join(dir, "root", "link")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(dir, filepath.Join(dir, "root", "dirlink")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{
+		"../secret",
+		"foo/../../secret",
+		"/secret",
+		filepath.Join(dir, "secret"),
+		"link",
+		"dirlink/secret",
+	} {
+		if _, _, err := f.Open(ctx, key); err != ErrAccessViolation {
+			t.Errorf("Reading %s: expected ErrAccessViolation, got %v", key, err)
+		}
+		if _, err := f.Create(ctx, key); err != ErrAccessViolation {
+			t.Errorf("Writing %s: expected ErrAccessViolation, got %v", key, err)
+		}
+	}
+
+	if data, _ := ioutil.ReadFile(filepath.Join(dir, "secret")); string(data) != "secret" {
+		t.Error("File outside the root was overwritten")
+	}
+}
+
+func TestHandleWriteAccessViolation(t *testing.T) {
+	f, _, cleanup := newTestFileDataStore(t)
+	defer cleanup()
+
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := &ServerConfig{Store: f}
+
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "../escape"}
+	handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	calls := callCounter["sendError"]
+	if len(calls) < 1 || calls[0]["code"] != uint16(2) {
+		t.Errorf("Expected error 2 for a write outside the root, got %v", calls)
+	}
+	if len(callCounter["receiveData"]) > 0 {
+		t.Error("handleWrite accepted data for a write outside the root")
+	}
+}
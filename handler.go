@@ -0,0 +1,81 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"net"
+)
+
+// Request describes a read or write request, as handed to a ReadHandler
+// or WriteHandler.
+type Request struct {
+	// Op is OpRRQ or OpWRQ.
+	Op uint16
+	// Filename is the name of the file the client asked for.
+	Filename string
+	// Mode is the transfer mode, "octet" or "netascii", in whatever case
+	// the client used.  Netascii conversion is done by the server, so
+	// handlers deal in local text either way.
+	Mode string
+	// Options holds the options the server has acknowledged, with lower
+	// case names.  It is nil if there are none.  Handlers should treat it
+	// as read only.
+	Options map[string]string
+	// RemoteAddr is the address of the client.
+	RemoteAddr net.Addr
+}
+
+// ReadHandler provides the contents of files clients read, like an
+// http.Handler for TFTP.  It may generate them on the fly, for example
+// from the client's address.
+//
+// ServeRead returns a reader for the contents of the file, along with
+// its size in bytes, or -1 if the size isn't known.  ErrNotFound and
+// ErrAccessViolation are reported to the client with the matching TFTP
+// error code, as is the code of a *PacketError.  Implementations must
+// be safe for concurrent use.
+type ReadHandler interface {
+	ServeRead(ctx context.Context, r *Request) (io.ReadCloser, int64, error)
+}
+
+// WriteHandler receives the contents of files clients write.
+//
+// ServeWrite returns a writer for the contents of the file, which is
+// committed if the transfer succeeds, and aborted if not.  It should fail
+// straight away if the file can't be written, before the client sends any
+// data.  Errors are reported to the client as they are by ReadHandler.
+type WriteHandler interface {
+	ServeWrite(ctx context.Context, r *Request) (FileWriter, error)
+}
+
+// ReadHandlerFunc adapts an ordinary function to a ReadHandler.
+type ReadHandlerFunc func(ctx context.Context, r *Request) (io.ReadCloser, int64, error)
+
+// ServeRead calls f(ctx, r).
+func (f ReadHandlerFunc) ServeRead(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+	return f(ctx, r)
+}
+
+// WriteHandlerFunc adapts an ordinary function to a WriteHandler.
+type WriteHandlerFunc func(ctx context.Context, r *Request) (FileWriter, error)
+
+// ServeWrite calls f(ctx, r).
+func (f WriteHandlerFunc) ServeWrite(ctx context.Context, r *Request) (FileWriter, error) {
+	return f(ctx, r)
+}
+
+// StoreHandler serves reads and writes from a Datastore,
+// with the filename as the key.
+type StoreHandler struct {
+	Store Datastore
+}
+
+// ServeRead opens the file named in r.
+func (h StoreHandler) ServeRead(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+	return h.Store.Open(ctx, r.Filename)
+}
+
+// ServeWrite creates the file named in r.
+func (h StoreHandler) ServeWrite(ctx context.Context, r *Request) (FileWriter, error) {
+	return h.Store.Create(ctx, r.Filename)
+}
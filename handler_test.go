@@ -0,0 +1,112 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestReadHandler(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	var served *Request
+	config := &ServerConfig{
+		ReadHandler: ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+			served = r
+			// a config file for each client
+			content := "host " + r.RemoteAddr.String() + "\n"
+			return ioutil.NopCloser(strings.NewReader(content)), int64(len(content)), nil
+		}),
+	}
+
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 1234}
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: "pxelinux.cfg/default", Options: map[string]string{"blksize": "1024"}}
+	if err := handleRead(context.Background(), &testPacketConn.Server, p, addr, config, testUtils); err != nil {
+		t.Fatal(err)
+	}
+
+	checkErrors(callCounter, t)
+	if served == nil || served.Op != OpRRQ || served.Filename != "pxelinux.cfg/default" || served.Mode != "octet" || served.RemoteAddr != addr {
+		t.Errorf("Unexpected request %+v", served)
+	}
+	if served.Options["blksize"] != "1024" {
+		t.Errorf("Expected the handler to see the options, got %v", served.Options)
+	}
+	calls := callCounter["sendData"]
+	if len(calls) < 1 {
+		t.Fatal("handleRead failed to call sendData")
+	}
+	if string(calls[0]["data"].([]byte)) != "host 10.0.0.7:1234\n" {
+		t.Errorf("Expected generated content, got %q", calls[0]["data"])
+	}
+}
+
+func TestWriteHandler(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	uploads := NewMapDataStore()
+	config := newTestConfig()
+	config.WriteHandler = WriteHandlerFunc(func(ctx context.Context, r *Request) (FileWriter, error) {
+		// keep uploads apart, by client
+		return uploads.Create(ctx, r.RemoteAddr.String()+"/"+r.Filename)
+	})
+
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 1234}
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "log"}
+	if err := handleWrite(context.Background(), &testPacketConn.Server, p, addr, config, testUtils); err != nil {
+		t.Fatal(err)
+	}
+
+	checkErrors(callCounter, t)
+	if !bytes.Equal(getTestData(t, uploads, "10.0.0.7:1234/log"), testPayload) {
+		t.Error("input data does not match stored data.")
+	}
+	if _, _, err := config.Store.Open(context.Background(), "log"); err != ErrNotFound {
+		t.Error("handleWrite wrote to the store instead of the handler")
+	}
+}
+
+func TestHandlerPacketError(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	config := &ServerConfig{
+		WriteHandler: WriteHandlerFunc(func(ctx context.Context, r *Request) (FileWriter, error) {
+			return nil, &PacketError{Code: 6, Msg: "File already exists"}
+		}),
+	}
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "log"}
+	handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	calls := callCounter["sendError"]
+	if len(calls) < 1 || calls[0]["code"] != uint16(6) || calls[0]["message"] != "File already exists" {
+		t.Errorf("Expected the handler's error to be sent, got %v", calls)
+	}
+}
+
+func TestNoHandler(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	// a server that only generates files can't be written to
+	config := &ServerConfig{
+		ReadHandler: ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+			return nil, 0, ErrNotFound
+		}),
+	}
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "log"}
+	if err := handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils); err != ErrAccessViolation {
+		t.Errorf("Expected an access violation, got %v", err)
+	}
+
+	calls := callCounter["sendError"]
+	if len(calls) < 1 || calls[0]["code"] != uint16(2) {
+		t.Errorf("Expected error 2, got %v", calls)
+	}
+}
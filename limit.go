@@ -0,0 +1,252 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits protects a server from floods of requests.  A request over a
+// limit is answered with an ERROR packet from the listening port, rather
+// than being dropped, so the client gives up instead of retrying.  Zero
+// means no limit.
+type Limits struct {
+	// MaxTransfers caps the transfers in progress at once, and
+	// MaxClientTransfers those from any one IP address.
+	MaxTransfers       int
+	MaxClientTransfers int
+	// RequestRate caps the new requests accepted each second, and
+	// ClientRequestRate those from any one IP address.  Bursts of up to a
+	// second's worth are allowed.
+	RequestRate       float64
+	ClientRequestRate float64
+}
+
+var (
+	errBusy        = errors.New("Server busy, try again later")
+	errClientBusy  = errors.New("Too many transfers from this address")
+	errRateLimited = errors.New("Too many requests, try again later")
+)
+
+// maxIdleClients is how many addresses a limiter keeps the state of before
+// it forgets those with nothing left to remember.
+const maxIdleClients = 1024
+
+// limiter enforces Limits for a server.
+type limiter struct {
+	mu        sync.Mutex
+	transfers int
+	requests  *tokenBucket
+	clients   map[string]*clientLimits
+}
+
+// clientLimits is the state of a single IP address.
+type clientLimits struct {
+	transfers int
+	requests  *tokenBucket
+}
+
+// admit counts a new transfer from ip, or returns the error to refuse it
+// with if that would break limits.  Each transfer admitted must be
+// released once it ends.
+func (l *limiter) admit(limits Limits, ip net.IP, now time.Time) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.clients == nil {
+		l.clients = make(map[string]*clientLimits)
+	}
+	if len(l.clients) > maxIdleClients {
+		l.forget(now)
+	}
+	key := ip.String()
+	client, ok := l.clients[key]
+	if !ok {
+		client = &clientLimits{}
+		l.clients[key] = client
+	}
+
+	if limits.RequestRate > 0 && (l.requests == nil || l.requests.rate != limits.RequestRate) {
+		l.requests = newTokenBucket(limits.RequestRate, now)
+	}
+	if limits.ClientRequestRate > 0 && (client.requests == nil || client.requests.rate != limits.ClientRequestRate) {
+		client.requests = newTokenBucket(limits.ClientRequestRate, now)
+	}
+
+	// every limit is checked before any token is taken, so a request
+	// refused by one doesn't use up the others, and a client over its
+	// own limits can't drain the server's
+	if limits.ClientRequestRate > 0 && !client.requests.ready(now) {
+		return errRateLimited
+	}
+	if limits.MaxClientTransfers > 0 && client.transfers >= limits.MaxClientTransfers {
+		return errClientBusy
+	}
+	if limits.MaxTransfers > 0 && l.transfers >= limits.MaxTransfers {
+		return errBusy
+	}
+	if limits.RequestRate > 0 && !l.requests.ready(now) {
+		return errRateLimited
+	}
+	if limits.RequestRate > 0 {
+		l.requests.take(now)
+	}
+	if limits.ClientRequestRate > 0 {
+		client.requests.take(now)
+	}
+	l.transfers++
+	client.transfers++
+	return nil
+}
+
+// release counts the end of a transfer from ip.
+func (l *limiter) release(ip net.IP) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.transfers--
+	if client, ok := l.clients[ip.String()]; ok {
+		client.transfers--
+	}
+}
+
+// forget drops the addresses with no transfers in progress, whose request
+// rate has fully recovered, as they are no different to new ones.
+// The caller must hold l.mu.
+func (l *limiter) forget(now time.Time) {
+	for key, client := range l.clients {
+		if client.transfers == 0 && (client.requests == nil || client.requests.full(now)) {
+			delete(l.clients, key)
+		}
+	}
+}
+
+// tokenBucket allows events at rate a second on average,
+// in bursts of up to a second's worth.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, now time.Time) *tokenBucket {
+	burst := math.Max(1, math.Ceil(rate))
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: now}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.burst, b.tokens+elapsed.Seconds()*b.rate)
+		b.last = now
+	}
+}
+
+// ready reports whether an event is allowed at now, without counting it.
+func (b *tokenBucket) ready(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= 1
+}
+
+// take reports whether an event is allowed at now, and counts it if so.
+func (b *tokenBucket) take(now time.Time) bool {
+	if !b.ready(now) {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *tokenBucket) full(now time.Time) bool {
+	b.refill(now)
+	return b.tokens >= b.burst
+}
+
+// Throttle returns middleware that shapes each transfer to at most
+// bytesPerSecond, by pausing between blocks.  As the client waits for
+// each block, or its acknowledgement, a rate below a few blocks a second
+// may make it time out.  A rate of zero or less leaves transfers alone.
+func Throttle(bytesPerSecond int64) Middleware {
+	if bytesPerSecond <= 0 {
+		return Middleware{}
+	}
+	return Middleware{
+		Read: func(next ReadHandler) ReadHandler {
+			return ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+				file, size, err := next.ServeRead(ctx, r)
+				if err != nil {
+					return nil, 0, err
+				}
+				return &throttledReader{ReadCloser: file, pace: newPace(ctx, bytesPerSecond)}, size, nil
+			})
+		},
+		Write: func(next WriteHandler) WriteHandler {
+			return WriteHandlerFunc(func(ctx context.Context, r *Request) (FileWriter, error) {
+				file, err := next.ServeWrite(ctx, r)
+				if err != nil {
+					return nil, err
+				}
+				return &throttledWriter{FileWriter: file, pace: newPace(ctx, bytesPerSecond)}, nil
+			})
+		},
+	}
+}
+
+// pace delays a transfer so it keeps to a rate.
+type pace struct {
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+func newPace(ctx context.Context, rate int64) *pace {
+	return &pace{ctx: ctx, rate: rate, start: time.Now()}
+}
+
+// wait counts n more bytes, and sleeps until they are within the rate,
+// or returns early with the error of ctx.
+func (p *pace) wait(n int) error {
+	p.bytes += int64(n)
+	due := p.start.Add(time.Duration(float64(p.bytes) / float64(p.rate) * float64(time.Second)))
+	delay := time.Until(due)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	}
+}
+
+type throttledReader struct {
+	io.ReadCloser
+	pace *pace
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if werr := t.pace.wait(n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+type throttledWriter struct {
+	FileWriter
+	pace *pace
+}
+
+func (t *throttledWriter) Write(p []byte) (int, error) {
+	n, err := t.FileWriter.Write(p)
+	if werr := t.pace.wait(n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
@@ -0,0 +1,185 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	b := newTokenBucket(2, now)
+	if !b.take(now) || !b.take(now) {
+		t.Fatal("Expected a burst of a second's worth to be allowed")
+	}
+	if b.take(now) {
+		t.Error("Expected the third request in a burst to be refused")
+	}
+	if b.take(now.Add(400 * time.Millisecond)) {
+		t.Error("Expected a request to be refused until the bucket refills")
+	}
+	if !b.take(now.Add(500 * time.Millisecond)) {
+		t.Error("Expected a request to be allowed once the bucket refills")
+	}
+	if b.full(now.Add(time.Second)) || !b.full(now.Add(1500*time.Millisecond)) {
+		t.Error("Expected the bucket to be full a second after it emptied")
+	}
+
+	// a slow rate still allows a single request
+	b = newTokenBucket(0.5, now)
+	if !b.take(now) || b.take(now.Add(time.Second)) || !b.take(now.Add(2*time.Second)) {
+		t.Error("Expected one request every two seconds to be allowed")
+	}
+}
+
+func TestLimiterTransfers(t *testing.T) {
+	var l limiter
+	limits := Limits{MaxTransfers: 3, MaxClientTransfers: 2}
+	now := time.Now()
+	a, b, c := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2), net.IPv4(10, 0, 0, 3)
+
+	for _, ip := range []net.IP{a, a, b} {
+		if err := l.admit(limits, ip, now); err != nil {
+			t.Fatalf("Expected a transfer from %s to be admitted, got %v", ip, err)
+		}
+	}
+	if err := l.admit(limits, c, now); err != errBusy {
+		t.Errorf("Expected errBusy, got %v", err)
+	}
+	l.release(b)
+	if err := l.admit(limits, a, now); err != errClientBusy {
+		t.Errorf("Expected errClientBusy, got %v", err)
+	}
+	if err := l.admit(limits, c, now); err != nil {
+		t.Errorf("Expected a transfer to be admitted once another ended, got %v", err)
+	}
+}
+
+func TestLimiterRequestRate(t *testing.T) {
+	var l limiter
+	limits := Limits{RequestRate: 3, ClientRequestRate: 1}
+	now := time.Now()
+	a, b := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	if err := l.admit(limits, a, now); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.admit(limits, a, now); err != errRateLimited {
+		t.Errorf("Expected a second request from %s to be refused, got %v", a, err)
+	}
+	if err := l.admit(limits, b, now); err != nil {
+		t.Errorf("Expected a request from %s to be admitted, got %v", b, err)
+	}
+	// the refused request didn't count against the server's rate
+	if err := l.admit(limits, net.IPv4(10, 0, 0, 3), now); err != nil {
+		t.Errorf("Expected a third request to be admitted, got %v", err)
+	}
+	if err := l.admit(limits, net.IPv4(10, 0, 0, 4), now); err != errRateLimited {
+		t.Errorf("Expected the server's rate to be exceeded, got %v", err)
+	}
+	if err := l.admit(limits, a, now.Add(time.Second)); err != nil {
+		t.Errorf("Expected a request to be admitted a second later, got %v", err)
+	}
+}
+
+func TestLimiterRefusalsTakeNoTokens(t *testing.T) {
+	var l limiter
+	limits := Limits{RequestRate: 2, MaxClientTransfers: 1}
+	now := time.Now()
+	flood, other := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+
+	if err := l.admit(limits, flood, now); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := l.admit(limits, flood, now); err != errClientBusy {
+			t.Fatalf("Expected errClientBusy, got %v", err)
+		}
+	}
+	if err := l.admit(limits, other, now); err != nil {
+		t.Errorf("Expected a client over its own limit not to use up the server's rate, got %v", err)
+	}
+}
+
+func TestLimiterForgetsIdleClients(t *testing.T) {
+	var l limiter
+	limits := Limits{ClientRequestRate: 1}
+	now := time.Now()
+	busy := net.IPv4(192, 0, 2, 1)
+	l.admit(limits, busy, now)
+	for i := 0; i <= maxIdleClients; i++ {
+		ip := net.IPv4(10, 0, byte(i>>8), byte(i))
+		if err := l.admit(limits, ip, now); err != nil {
+			t.Fatal(err)
+		}
+		l.release(ip)
+	}
+	l.admit(limits, busy, now.Add(time.Minute))
+	if len(l.clients) != 1 {
+		t.Errorf("Expected only the busy client to be remembered, got %d", len(l.clients))
+	}
+}
+
+func TestServeLimits(t *testing.T) {
+	conn := NewPacketConn()
+	release := make(chan struct{})
+	s, started := newTestServer(func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	s.Limits = Limits{MaxClientTransfers: 1}
+	go s.Serve(&conn.Server)
+	defer s.Shutdown(context.Background())
+	defer close(release)
+
+	request := PacketRequest{Op: OpRRQ, Filename: "foo", Mode: "octet"}
+	conn.Client.WriteTo(request.Serialize(), nil)
+	<-started
+
+	// another is refused, with an error from the listening port
+	request.Filename = "bar"
+	conn.Client.WriteTo(request.Serialize(), nil)
+	buf := make([]byte, MaxPacketSize)
+	n, _, err := conn.Client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParsePacket(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := p.(*PacketError); !ok || e.Code != 0 || e.Msg != errClientBusy.Error() {
+		t.Errorf("Expected an error refusing the request, got %+v", p)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	store := NewMapDataStore()
+	data := bytes.Repeat([]byte{42}, 300)
+	setTestData(t, store, "foo", data)
+	h := wrapRead(StoreHandler{Store: store}, []Middleware{Throttle(1000)})
+
+	file, _, err := h.ServeRead(context.Background(), &Request{Filename: "foo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	read, err := ioutil.ReadAll(file)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("Expected the file to be read whole, got %d bytes and %v", len(read), err)
+	}
+	if elapsed := time.Since(start); elapsed < 250*time.Millisecond {
+		t.Errorf("Expected 300 bytes at 1000 bytes a second to take 300ms, took %s", elapsed)
+	}
+
+	// a cancelled transfer isn't held up
+	ctx, cancel := context.WithCancel(context.Background())
+	file, _, _ = h.ServeRead(ctx, &Request{Filename: "foo"})
+	cancel()
+	if _, err = ioutil.ReadAll(file); err != context.Canceled {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+}
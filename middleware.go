@@ -0,0 +1,117 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"log"
+)
+
+// Middleware wraps the handlers of a server, so that logging, access
+// control, rate limiting, metrics or filename rewriting can each be
+// written once, as a layer of its own, and composed in ServerConfig.
+// A layer may answer a request itself, by returning an error such as
+// ErrAccessViolation or a *PacketError, change the request before
+// passing it on, or wrap the reader or writer it gets back.  Either
+// function may be nil, to leave that kind of request alone.
+type Middleware struct {
+	Read  func(next ReadHandler) ReadHandler
+	Write func(next WriteHandler) WriteHandler
+}
+
+// wrapRead applies the Read layers of middleware to h, so the first
+// layer is the outermost, and sees each request first.
+func wrapRead(h ReadHandler, middleware []Middleware) ReadHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i].Read != nil {
+			h = middleware[i].Read(h)
+		}
+	}
+	return h
+}
+
+// wrapWrite applies the Write layers of middleware to h, as wrapRead does.
+func wrapWrite(h WriteHandler, middleware []Middleware) WriteHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		if middleware[i].Write != nil {
+			h = middleware[i].Write(h)
+		}
+	}
+	return h
+}
+
+// LogRequests returns middleware that logs each request to logger,
+// and how much data the transfer it starts moves.
+func LogRequests(logger *log.Logger) Middleware {
+	return Middleware{
+		Read: func(next ReadHandler) ReadHandler {
+			return ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+				file, size, err := next.ServeRead(ctx, r)
+				if err != nil {
+					logger.Printf("Read of %s by %s refused: %s", r.Filename, r.RemoteAddr.String(), err.Error())
+					return nil, 0, err
+				}
+				logger.Printf("Read of %s by %s started", r.Filename, r.RemoteAddr.String())
+				return &loggedReader{ReadCloser: file, logger: logger, r: r}, size, nil
+			})
+		},
+		Write: func(next WriteHandler) WriteHandler {
+			return WriteHandlerFunc(func(ctx context.Context, r *Request) (FileWriter, error) {
+				file, err := next.ServeWrite(ctx, r)
+				if err != nil {
+					logger.Printf("Write of %s by %s refused: %s", r.Filename, r.RemoteAddr.String(), err.Error())
+					return nil, err
+				}
+				logger.Printf("Write of %s by %s started", r.Filename, r.RemoteAddr.String())
+				return &loggedWriter{FileWriter: file, logger: logger, r: r}, nil
+			})
+		},
+	}
+}
+
+// loggedReader logs how much was read when the transfer ends.
+type loggedReader struct {
+	io.ReadCloser
+	logger *log.Logger
+	r      *Request
+	n      int64
+}
+
+func (l *loggedReader) Read(p []byte) (int, error) {
+	n, err := l.ReadCloser.Read(p)
+	l.n += int64(n)
+	return n, err
+}
+
+func (l *loggedReader) Close() error {
+	l.logger.Printf("Read of %s by %s ended after %d bytes", l.r.Filename, l.r.RemoteAddr.String(), l.n)
+	return l.ReadCloser.Close()
+}
+
+// loggedWriter logs whether a written file was kept, and its size.
+type loggedWriter struct {
+	FileWriter
+	logger *log.Logger
+	r      *Request
+	n      int64
+}
+
+func (l *loggedWriter) Write(p []byte) (int, error) {
+	n, err := l.FileWriter.Write(p)
+	l.n += int64(n)
+	return n, err
+}
+
+func (l *loggedWriter) Commit() error {
+	err := l.FileWriter.Commit()
+	if err != nil {
+		l.logger.Printf("Write of %s by %s failed to commit: %s", l.r.Filename, l.r.RemoteAddr.String(), err.Error())
+	} else {
+		l.logger.Printf("Write of %s by %s stored %d bytes", l.r.Filename, l.r.RemoteAddr.String(), l.n)
+	}
+	return err
+}
+
+func (l *loggedWriter) Abort() error {
+	l.logger.Printf("Write of %s by %s abandoned after %d bytes", l.r.Filename, l.r.RemoteAddr.String(), l.n)
+	return l.FileWriter.Abort()
+}
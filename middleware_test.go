@@ -0,0 +1,109 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"testing"
+)
+
+// tracer returns middleware that records the filename each layer sees
+func tracer(name string, seen *[]string) Middleware {
+	return Middleware{
+		Read: func(next ReadHandler) ReadHandler {
+			return ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+				*seen = append(*seen, name+":"+r.Filename)
+				return next.ServeRead(ctx, r)
+			})
+		},
+	}
+}
+
+// rewriter returns middleware that adds prefix to filenames
+func rewriter(prefix string) Middleware {
+	return Middleware{
+		Read: func(next ReadHandler) ReadHandler {
+			return ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+				rewritten := *r
+				rewritten.Filename = prefix + r.Filename
+				return next.ServeRead(ctx, &rewritten)
+			})
+		},
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+	setTestData(t, config.Store, "boot/pxelinux.0", []byte{42})
+
+	var seen []string
+	config.Middleware = []Middleware{tracer("outer", &seen), rewriter("boot/"), tracer("inner", &seen)}
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: "pxelinux.0"}
+	if err := handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils); err != nil {
+		t.Fatal(err)
+	}
+
+	checkErrors(callCounter, t)
+	if strings.Join(seen, " ") != "outer:pxelinux.0 inner:boot/pxelinux.0" {
+		t.Errorf("Unexpected order of layers: %v", seen)
+	}
+	if calls := callCounter["sendData"]; len(calls) < 1 || !bytes.Equal(calls[0]["data"].([]byte), []byte{42}) {
+		t.Error("Expected the rewritten file to be sent")
+	}
+}
+
+func TestMiddlewareRefuses(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+
+	// a read only server
+	config.Middleware = []Middleware{{
+		Write: func(next WriteHandler) WriteHandler {
+			return WriteHandlerFunc(func(ctx context.Context, r *Request) (FileWriter, error) {
+				return nil, ErrAccessViolation
+			})
+		},
+	}}
+
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "fname"}
+	if err := handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils); err != ErrAccessViolation {
+		t.Errorf("Expected an access violation, got %v", err)
+	}
+	calls := callCounter["sendError"]
+	if len(calls) < 1 || calls[0]["code"] != uint16(2) {
+		t.Errorf("Expected error 2, got %v", calls)
+	}
+	if len(callCounter["receiveData"]) > 0 {
+		t.Error("handleWrite received data for a refused write")
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, _ := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+	var logged bytes.Buffer
+	config.Middleware = []Middleware{LogRequests(log.New(&logged, "", 0))}
+
+	addr := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 7), Port: 1234}
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "fname"}
+	handleWrite(context.Background(), &testPacketConn.Server, p, addr, config, testUtils)
+	p = PacketRequest{Op: OpRRQ, Mode: "octet", Filename: "missing"}
+	handleRead(context.Background(), &testPacketConn.Server, p, addr, config, testUtils)
+
+	expected := []string{
+		"Write of fname by 10.0.0.7:1234 started",
+		"Write of fname by 10.0.0.7:1234 stored 1 bytes",
+		"Read of missing by 10.0.0.7:1234 refused: file not found",
+	}
+	if lines := strings.Split(strings.TrimSpace(logged.String()), "\n"); strings.Join(lines, "|") != strings.Join(expected, "|") {
+		t.Errorf("Unexpected log:\n%s", logged.String())
+	}
+}
@@ -0,0 +1,166 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"path"
+	"strings"
+	"sync"
+)
+
+// Handler serves both reads and writes, as StoreHandler and ServeMux do.
+type Handler interface {
+	ReadHandler
+	WriteHandler
+}
+
+// ServeMux routes requests to handlers by filename, like http.ServeMux.
+// A pattern is one of:
+//
+//	pxelinux.0          the file of that name, exactly
+//	configs/            any file starting with the prefix, which ends in /
+//	pxelinux.cfg/*      any file matching the glob, as path.Match does
+//	/                   any file at all
+//
+// Clients differ on whether filenames start with a slash, so a leading
+// slash is ignored, in both filenames and patterns.  An exact pattern
+// always wins.  Otherwise the longest matching pattern
+// does, so "configs/site1/" takes precedence over "configs/".  Reads and
+// writes are routed separately, so a pattern may have a different handler
+// for each.  A ServeMux is installed on a server by setting it as both
+// the ReadHandler and the WriteHandler of the ServerConfig.
+type ServeMux struct {
+	mu     sync.RWMutex
+	routes map[string]*muxEntry
+}
+
+// muxEntry holds the handlers for a pattern, either of which may be nil.
+type muxEntry struct {
+	read  ReadHandler
+	write WriteHandler
+}
+
+// NewServeMux returns an empty ServeMux, which refuses every request.
+// The zero value is ready to use too.
+func NewServeMux() *ServeMux {
+	return &ServeMux{routes: make(map[string]*muxEntry)}
+}
+
+// Handle routes both reads and writes for pattern to h.
+func (mux *ServeMux) Handle(pattern string, h Handler) {
+	mux.HandleRead(pattern, h)
+	mux.HandleWrite(pattern, h)
+}
+
+// HandleRead routes reads for pattern to h.
+// It panics if pattern is invalid, or already has a read handler.
+func (mux *ServeMux) HandleRead(pattern string, h ReadHandler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	e := mux.entry(pattern)
+	if e.read != nil {
+		panic("tftp: multiple read handlers for " + pattern)
+	}
+	e.read = h
+}
+
+// HandleWrite routes writes for pattern to h.
+// It panics if pattern is invalid, or already has a write handler.
+func (mux *ServeMux) HandleWrite(pattern string, h WriteHandler) {
+	mux.mu.Lock()
+	defer mux.mu.Unlock()
+	e := mux.entry(pattern)
+	if e.write != nil {
+		panic("tftp: multiple write handlers for " + pattern)
+	}
+	e.write = h
+}
+
+// ServeRead passes r to the read handler for its filename,
+// or returns ErrNotFound if there is none.
+func (mux *ServeMux) ServeRead(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+	mux.mu.RLock()
+	e := mux.match(r.Filename, func(e *muxEntry) bool { return e.read != nil })
+	mux.mu.RUnlock()
+	if e == nil {
+		return nil, 0, ErrNotFound
+	}
+	return e.read.ServeRead(ctx, r)
+}
+
+// ServeWrite passes r to the write handler for its filename,
+// or returns ErrAccessViolation if there is none.
+func (mux *ServeMux) ServeWrite(ctx context.Context, r *Request) (FileWriter, error) {
+	mux.mu.RLock()
+	e := mux.match(r.Filename, func(e *muxEntry) bool { return e.write != nil })
+	mux.mu.RUnlock()
+	if e == nil {
+		return nil, ErrAccessViolation
+	}
+	return e.write.ServeWrite(ctx, r)
+}
+
+// entry returns the entry for pattern, adding it if need be.
+// The caller must hold mux.mu for writing.
+func (mux *ServeMux) entry(pattern string) *muxEntry {
+	checkPattern(pattern)
+	if pattern != "/" {
+		pattern = strings.TrimPrefix(pattern, "/")
+	}
+	if mux.routes == nil {
+		mux.routes = make(map[string]*muxEntry)
+	}
+	e, ok := mux.routes[pattern]
+	if !ok {
+		e = &muxEntry{}
+		mux.routes[pattern] = e
+	}
+	return e
+}
+
+// match returns the entry that filename is routed to, among those
+// accepted by usable, or nil if none of their patterns match it.
+// The caller must hold mux.mu.
+func (mux *ServeMux) match(filename string, usable func(*muxEntry) bool) *muxEntry {
+	filename = strings.TrimPrefix(filename, "/")
+	if e, ok := mux.routes[filename]; ok && usable(e) {
+		return e
+	}
+	var best *muxEntry
+	bestLen := 0
+	for pattern, e := range mux.routes {
+		if len(pattern) > bestLen && usable(e) && matches(filename, pattern) {
+			best, bestLen = e, len(pattern)
+		}
+	}
+	return best
+}
+
+// matches reports whether filename matches a prefix or glob pattern.
+func matches(filename, pattern string) bool {
+	if pattern == "/" {
+		return true
+	}
+	if isGlob(pattern) {
+		ok, _ := path.Match(pattern, filename)
+		return ok
+	}
+	return strings.HasSuffix(pattern, "/") && strings.HasPrefix(filename, pattern)
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+// checkPattern panics if pattern can never match, as
+// registering it must be a mistake.
+func checkPattern(pattern string) {
+	if pattern == "" {
+		panic("tftp: empty pattern")
+	}
+	if isGlob(pattern) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			panic("tftp: invalid pattern " + pattern)
+		}
+	}
+}
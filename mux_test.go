@@ -0,0 +1,148 @@
+package tftp
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+// namedHandler serves reads with its name, and records writes
+type namedHandler string
+
+func (h namedHandler) ServeRead(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+	return ioutil.NopCloser(strings.NewReader(string(h))), int64(len(h)), nil
+}
+
+func (h namedHandler) ServeWrite(ctx context.Context, r *Request) (FileWriter, error) {
+	return nil, &PacketError{Code: 0, Msg: string(h)}
+}
+
+// routedTo returns the name of the handler that serves a read of filename
+func routedTo(t *testing.T, mux *ServeMux, filename string) string {
+	r, _, err := mux.ServeRead(context.Background(), &Request{Op: OpRRQ, Filename: filename})
+	if err == ErrNotFound {
+		return ""
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	name, _ := ioutil.ReadAll(r)
+	return string(name)
+}
+
+func TestServeMuxRoutes(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleRead("pxelinux.0", namedHandler("exact"))
+	mux.HandleRead("pxelinux.cfg/*", namedHandler("glob"))
+	mux.HandleRead("pxelinux.cfg/01-*", namedHandler("mac"))
+	mux.HandleRead("configs/", namedHandler("prefix"))
+	mux.HandleRead("configs/site1/", namedHandler("longer prefix"))
+
+	var tests = []struct {
+		filename string
+		handler  string
+	}{
+		{"pxelinux.0", "exact"},
+		{"/pxelinux.0", "exact"},
+		{"pxelinux.00", ""},
+		{"pxelinux.cfg/default", "glob"},
+		{"pxelinux.cfg/01-aa-bb-cc-dd-ee-ff", "mac"},
+		{"pxelinux.cfg/sub/default", ""},
+		{"configs/router", "prefix"},
+		{"configs/site1/router", "longer prefix"},
+		{"configs", ""},
+		{"other", ""},
+	}
+	for _, test := range tests {
+		if handler := routedTo(t, mux, test.filename); handler != test.handler {
+			t.Errorf("%s: expected handler %q, got %q", test.filename, test.handler, handler)
+		}
+	}
+
+	// a catch-all takes anything the other patterns don't
+	mux.HandleRead("/", namedHandler("default"))
+	if handler := routedTo(t, mux, "other"); handler != "default" {
+		t.Errorf("Expected the catch-all to serve other, got %q", handler)
+	}
+	if handler := routedTo(t, mux, "configs/router"); handler != "prefix" {
+		t.Errorf("Expected the prefix to beat the catch-all, got %q", handler)
+	}
+}
+
+func TestServeMuxSeparatesReadsAndWrites(t *testing.T) {
+	var mux ServeMux
+	mux.HandleRead("configs/", namedHandler("templates"))
+	mux.HandleWrite("configs/", namedHandler("backups"))
+	mux.Handle("/", namedHandler("store"))
+
+	if handler := routedTo(t, &mux, "configs/router"); handler != "templates" {
+		t.Errorf("Expected reads to go to templates, got %q", handler)
+	}
+	_, err := mux.ServeWrite(context.Background(), &Request{Op: OpWRQ, Filename: "configs/router"})
+	if remote, ok := err.(*PacketError); !ok || remote.Msg != "backups" {
+		t.Errorf("Expected writes to go to backups, got %v", err)
+	}
+	_, err = mux.ServeWrite(context.Background(), &Request{Op: OpWRQ, Filename: "other"})
+	if remote, ok := err.(*PacketError); !ok || remote.Msg != "store" {
+		t.Errorf("Expected other writes to go to the store, got %v", err)
+	}
+}
+
+func TestServeMuxNoRoute(t *testing.T) {
+	mux := NewServeMux()
+	mux.HandleRead("configs/", namedHandler("templates"))
+
+	if _, err := mux.ServeWrite(context.Background(), &Request{Op: OpWRQ, Filename: "configs/router"}); err != ErrAccessViolation {
+		t.Errorf("Expected a write with no route to be refused, got %v", err)
+	}
+	if _, _, err := mux.ServeRead(context.Background(), &Request{Op: OpRRQ, Filename: "other"}); err != ErrNotFound {
+		t.Errorf("Expected a read with no route to be not found, got %v", err)
+	}
+}
+
+func TestServeMuxBadPatterns(t *testing.T) {
+	var tests = []func(mux *ServeMux){
+		func(mux *ServeMux) { mux.HandleRead("", namedHandler("empty")) },
+		func(mux *ServeMux) { mux.HandleRead("[", namedHandler("invalid")) },
+		func(mux *ServeMux) {
+			mux.HandleWrite("configs/", namedHandler("first"))
+			mux.HandleWrite("/configs/", namedHandler("second"))
+		},
+	}
+	for i, register := range tests {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("Test %d: expected a panic", i)
+				}
+			}()
+			register(NewServeMux())
+		}()
+	}
+}
+
+func TestServeMuxInstalled(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	store := NewMapDataStore()
+	setTestData(t, store, "pxelinux.0", []byte{42})
+	mux := NewServeMux()
+	mux.HandleRead("pxelinux.cfg/", namedHandler("generated"))
+	mux.Handle("/", StoreHandler{store})
+	config := &ServerConfig{ReadHandler: mux, WriteHandler: mux}
+
+	for filename, expected := range map[string]string{"pxelinux.0": "\x2a", "pxelinux.cfg/default": "generated"} {
+		p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: filename}
+		if err := handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils); err != nil {
+			t.Fatal(err)
+		}
+		calls := callCounter["sendData"]
+		if data := string(calls[len(calls)-1]["data"].([]byte)); data != expected {
+			t.Errorf("%s: expected %q, got %q", filename, expected, data)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package tftp
+
+import (
+	"bufio"
+	"io"
+)
+
+// netascii is the line-oriented text format from RFC 764, which RFC 1350
+// uses for text transfers.  Lines end in CR LF, and a CR that does not end
+// a line is sent as CR NUL.  The local form used here ends lines in LF alone.
+
+// NetasciiReader converts local text read from an underlying reader
+// into netascii.
+type NetasciiReader struct {
+	r       *bufio.Reader
+	pending []byte // the second byte of a CR LF or CR NUL pair, if not yet read
+}
+
+// NewNetasciiReader returns a reader producing the netascii form of the text in r.
+func NewNetasciiReader(r io.Reader) *NetasciiReader {
+	return &NetasciiReader{r: bufio.NewReader(r)}
+}
+
+func (n *NetasciiReader) Read(p []byte) (i int, err error) {
+	for i < len(p) {
+		if len(n.pending) > 0 {
+			p[i] = n.pending[0]
+			n.pending = n.pending[1:]
+			i++
+			continue
+		}
+		// don't block for more input if we already have something to return
+		if i > 0 && n.r.Buffered() == 0 {
+			return i, nil
+		}
+		var c byte
+		if c, err = n.r.ReadByte(); err != nil {
+			if i > 0 && err == io.EOF {
+				err = nil
+			}
+			return
+		}
+		switch c {
+		case '\n':
+			p[i] = '\r'
+			n.pending = []byte{'\n'}
+		case '\r':
+			p[i] = '\r'
+			n.pending = []byte{0}
+		default:
+			p[i] = c
+		}
+		i++
+	}
+	return
+}
+
+// NetasciiWriter converts netascii into local text, and writes it
+// to an underlying writer.
+type NetasciiWriter struct {
+	w  io.Writer
+	cr bool // the last byte written was a CR, which can't be translated yet
+}
+
+// NewNetasciiWriter returns a writer that writes the local form of
+// the netascii written to it into w.  Close must be called once all the
+// text has been written.
+func NewNetasciiWriter(w io.Writer) *NetasciiWriter {
+	return &NetasciiWriter{w: w}
+}
+
+func (n *NetasciiWriter) Write(p []byte) (int, error) {
+	out := make([]byte, 0, len(p)+1)
+	for _, c := range p {
+		if n.cr {
+			n.cr = false
+			switch c {
+			case '\n':
+				out = append(out, '\n')
+				continue
+			case 0:
+				out = append(out, '\r')
+				continue
+			default:
+				// not valid netascii, so keep the CR as it was
+				out = append(out, '\r')
+			}
+		}
+		if c == '\r' {
+			n.cr = true
+			continue
+		}
+		out = append(out, c)
+	}
+	if _, err := n.w.Write(out); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes out a trailing CR, if there is one.  It does not close
+// the underlying writer.
+func (n *NetasciiWriter) Close() error {
+	if !n.cr {
+		return nil
+	}
+	n.cr = false
+	_, err := n.w.Write([]byte{'\r'})
+	return err
+}
@@ -0,0 +1,63 @@
+package tftp
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"testing/iotest"
+)
+
+var netasciiTests = []struct {
+	local    string
+	netascii string
+}{
+	{"", ""},
+	{"foo", "foo"},
+	{"foo\n", "foo\r\n"},
+	{"foo\nbar\n", "foo\r\nbar\r\n"},
+	{"carriage\rreturn", "carriage\r\x00return"},
+	{"\r\n", "\r\x00\r\n"},
+	{"\n\n\r\r", "\r\n\r\n\r\x00\r\x00"},
+}
+
+func TestNetasciiReader(t *testing.T) {
+	for _, test := range netasciiTests {
+		// read a byte at a time, so pairs are split across reads
+		r := NewNetasciiReader(iotest.OneByteReader(bytes.NewBufferString(test.local)))
+		actual, err := ioutil.ReadAll(r)
+		if err != nil {
+			t.Errorf("Encoding %q: %s", test.local, err)
+		} else if string(actual) != test.netascii {
+			t.Errorf("Encoding %q: expected %q; got %q", test.local, test.netascii, actual)
+		}
+	}
+}
+
+func TestNetasciiWriter(t *testing.T) {
+	for _, test := range netasciiTests {
+		var buf bytes.Buffer
+		w := NewNetasciiWriter(&buf)
+		// write a byte at a time, so pairs are split across writes
+		for i := range test.netascii {
+			if _, err := w.Write([]byte{test.netascii[i]}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if buf.String() != test.local {
+			t.Errorf("Decoding %q: expected %q; got %q", test.netascii, test.local, buf.String())
+		}
+	}
+}
+
+func TestNetasciiWriterBareCR(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewNetasciiWriter(&buf)
+	w.Write([]byte("bare\rcr\r"))
+	w.Close()
+	if buf.String() != "bare\rcr\r" {
+		t.Errorf("Expected bare CRs to be kept, got %q", buf.String())
+	}
+}
@@ -0,0 +1,262 @@
+package tftp
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// RemapRule rewrites or refuses the filenames of requests matching
+// Pattern, much like a line of a tftpd-hpa remap file.
+type RemapRule struct {
+	Pattern *regexp.Regexp
+	// Replacement replaces the match when Rewrite is set, with $1 or
+	// ${name} standing for a submatch, as in regexp.Expand.
+	Replacement string
+
+	// Rewrite replaces the first match with Replacement,
+	// or every match if Global is set too.
+	Rewrite bool
+	Global  bool
+	// Lower folds the whole filename to lower case after any rewrite.
+	Lower bool
+	// Refuse answers the request with an access violation.
+	Refuse bool
+	// Stop skips the rules after this one.
+	Stop bool
+
+	// Op limits the rule to OpRRQ or OpWRQ.  Zero means both.
+	Op uint16
+	// Client limits the rule to requests from these addresses.
+	// Nil means any address.
+	Client *net.IPNet
+}
+
+// ParseRemapRules reads rules, one per line, in the form
+//
+//	flags regex [replacement] [client]
+//
+// Blank lines, and anything after a #, are ignored.  Fields are separated
+// by white space, so a regex matching a space must use \s or \x20, and
+// one matching a # must use \x23.  The flags are any of:
+//
+//	r  rewrite the first match with the replacement, which is only given
+//	   for rules with this flag, and may be "" to delete the match
+//	g  rewrite every match
+//	i  match regardless of case
+//	l  fold the filename to lower case
+//	a  refuse the request
+//	e  stop here if the rule matched
+//	G  only apply the rule to reads
+//	P  only apply the rule to writes
+//	-  nothing, as a placeholder
+//
+// The client, if given, is an IP address or CIDR block, and the rule only
+// applies to requests from it.  Rules are applied in order, each to the
+// filename left by those before it.  For example:
+//
+//	rg  \\          /           # Windows path separators
+//	r   ^/          ""          # leading slashes
+//	ri  ^boot/bcd$  boot/BCD    10.1.0.0/16
+//	a   \.\.                    # refuse anything else climbing out
+func ParseRemapRules(r io.Reader) ([]RemapRule, error) {
+	var rules []RemapRule
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		rule, err := parseRemapRule(fields)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", line, err.Error())
+		}
+		rules = append(rules, rule)
+	}
+	return rules, scanner.Err()
+}
+
+// LoadRemapRules reads rules from the file at path, as ParseRemapRules does.
+func LoadRemapRules(path string) ([]RemapRule, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	rules, err := ParseRemapRules(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err.Error())
+	}
+	return rules, nil
+}
+
+func parseRemapRule(fields []string) (rule RemapRule, err error) {
+	if len(fields) < 2 {
+		return rule, fmt.Errorf("expected flags and a regex")
+	}
+	caseless := false
+	for _, flag := range fields[0] {
+		switch flag {
+		case 'r':
+			rule.Rewrite = true
+		case 'g':
+			rule.Rewrite, rule.Global = true, true
+		case 'i':
+			caseless = true
+		case 'l':
+			rule.Lower = true
+		case 'a':
+			rule.Refuse = true
+		case 'e':
+			rule.Stop = true
+		case 'G':
+			rule.Op = OpRRQ
+		case 'P':
+			rule.Op = OpWRQ
+		case '-':
+		default:
+			return rule, fmt.Errorf("unknown flag %c", flag)
+		}
+	}
+	pattern := fields[1]
+	if caseless {
+		pattern = "(?i)" + pattern
+	}
+	if rule.Pattern, err = regexp.Compile(pattern); err != nil {
+		return rule, err
+	}
+	rest := fields[2:]
+	if rule.Rewrite && len(rest) > 0 {
+		rule.Replacement = rest[0]
+		if rule.Replacement == `""` {
+			rule.Replacement = ""
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		if rule.Client, err = parseClient(rest[0]); err != nil {
+			return rule, err
+		}
+		rest = rest[1:]
+	}
+	if len(rest) > 0 {
+		return rule, fmt.Errorf("unexpected %s", rest[0])
+	}
+	return rule, nil
+}
+
+// parseClient parses an IP address or CIDR block.
+func parseClient(s string) (*net.IPNet, error) {
+	if strings.Contains(s, "/") {
+		_, block, err := net.ParseCIDR(s)
+		return block, err
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid client address %s", s)
+	}
+	bits := 8 * net.IPv6len
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 8*net.IPv4len
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+// addrIP returns the IP address of addr, or nil if it has none.
+func addrIP(addr net.Addr) net.IP {
+	switch v := addr.(type) {
+	case *net.UDPAddr:
+		return v.IP
+	case nil:
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		host = addr.String()
+	}
+	return net.ParseIP(host)
+}
+
+// remap applies rules to the filename of r, returning the new filename,
+// or ErrAccessViolation if a rule refuses the request.
+func remap(rules []RemapRule, r *Request) (string, error) {
+	name := r.Filename
+	ip := addrIP(r.RemoteAddr)
+	for _, rule := range rules {
+		if rule.Op != 0 && rule.Op != r.Op {
+			continue
+		}
+		if rule.Client != nil && (ip == nil || !rule.Client.Contains(ip)) {
+			continue
+		}
+		match := rule.Pattern.FindStringSubmatchIndex(name)
+		if match == nil {
+			continue
+		}
+		if rule.Refuse {
+			return "", ErrAccessViolation
+		}
+		if rule.Global {
+			name = rule.Pattern.ReplaceAllString(name, rule.Replacement)
+		} else if rule.Rewrite {
+			replaced := rule.Pattern.ExpandString(nil, rule.Replacement, name, match)
+			name = name[:match[0]] + string(replaced) + name[match[1]:]
+		}
+		if rule.Lower {
+			name = strings.ToLower(name)
+		}
+		if rule.Stop {
+			break
+		}
+	}
+	return name, nil
+}
+
+// Remap returns middleware that rewrites the filename of each request
+// with rules, before passing it on to the handler.
+func Remap(rules []RemapRule) Middleware {
+	// rewrite returns a copy of r with its filename remapped
+	rewrite := func(r *Request) (*Request, error) {
+		name, err := remap(rules, r)
+		if err != nil {
+			OpLogger.Printf("Remap rules refused %s from %s", r.Filename, r.RemoteAddr.String())
+			return nil, err
+		}
+		if name == r.Filename {
+			return r, nil
+		}
+		OpLogger.Printf("Remapped %s to %s", r.Filename, name)
+		remapped := *r
+		remapped.Filename = name
+		return &remapped, nil
+	}
+	return Middleware{
+		Read: func(next ReadHandler) ReadHandler {
+			return ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+				r, err := rewrite(r)
+				if err != nil {
+					return nil, 0, err
+				}
+				return next.ServeRead(ctx, r)
+			})
+		},
+		Write: func(next WriteHandler) WriteHandler {
+			return WriteHandlerFunc(func(ctx context.Context, r *Request) (FileWriter, error) {
+				r, err := rewrite(r)
+				if err != nil {
+					return nil, err
+				}
+				return next.ServeWrite(ctx, r)
+			})
+		},
+	}
+}
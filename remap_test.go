@@ -0,0 +1,117 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testRemapRules = `
+# Windows path separators, and leading slashes
+rg   \\            /
+r    ^/            ""
+
+ri   ^boot/bcd$    boot/BCD    10.1.0.0/16   # only site 1 has one
+le   ^Boot/        # everything under Boot is stored in lower case
+Pa   ^boot/        # boot images are read only
+r    ^(.*)\.EXE$   $1.exe
+`
+
+func TestRemapRules(t *testing.T) {
+	rules, err := ParseRemapRules(strings.NewReader(testRemapRules))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 6 {
+		t.Fatalf("Expected 6 rules, got %d", len(rules))
+	}
+
+	site1 := &net.UDPAddr{IP: net.IPv4(10, 1, 2, 3), Port: 1234}
+	site2 := &net.UDPAddr{IP: net.IPv4(10, 2, 2, 3), Port: 1234}
+	var tests = []struct {
+		op       uint16
+		filename string
+		addr     net.Addr
+		expected string
+		err      error
+	}{
+		{OpRRQ, `\boot\x86\bootmgr.exe`, site2, "boot/x86/bootmgr.exe", nil},
+		{OpRRQ, "/pxelinux.0", site2, "pxelinux.0", nil},
+		{OpRRQ, "///pxelinux.0", site2, "//pxelinux.0", nil},
+		{OpRRQ, `\Boot\BCD`, site1, "boot/BCD", nil},
+		{OpRRQ, `\Boot\BCD`, site2, "boot/bcd", nil},
+		{OpRRQ, `Boot\BOOTMGR.EXE`, site2, "boot/bootmgr.exe", nil},
+		{OpRRQ, "SETUP.EXE", site2, "SETUP.exe", nil},
+		{OpWRQ, "/boot/x86/bootmgr.exe", site1, "", ErrAccessViolation},
+		{OpWRQ, "logs/SETUP.EXE", site1, "logs/SETUP.exe", nil},
+	}
+	for _, test := range tests {
+		r := &Request{Op: test.op, Filename: test.filename, RemoteAddr: test.addr}
+		name, err := remap(rules, r)
+		if name != test.expected || err != test.err {
+			t.Errorf("%s from %s: expected (%q, %v), got (%q, %v)", test.filename, test.addr, test.expected, test.err, name, err)
+		}
+	}
+}
+
+func TestParseRemapRulesErrors(t *testing.T) {
+	var tests = []struct {
+		rules string
+		err   string
+	}{
+		{"r", "line 1: expected flags and a regex"},
+		{"\n\nx  ^/", "line 3: unknown flag x"},
+		{"r  (", "line 1: error parsing regexp"},
+		{"a  ^/  ten.0.0.1", "line 1: invalid client address ten.0.0.1"},
+		{"r  ^/  \"\"  10.0.0.0/8  extra", "line 1: unexpected extra"},
+	}
+	for _, test := range tests {
+		_, err := ParseRemapRules(strings.NewReader(test.rules))
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("%q: expected error %q, got %v", test.rules, test.err, err)
+		}
+	}
+}
+
+func TestRemapMiddleware(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	dir, err := ioutil.TempDir("", "tftp-remap")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "remap")
+	if err = ioutil.WriteFile(path, []byte(testRemapRules), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rules, err := LoadRemapRules(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := newTestConfig()
+	config.Middleware = []Middleware{Remap(rules)}
+	setTestData(t, config.Store, "boot/x86/bootmgr.exe", []byte{42})
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: `\boot\x86\bootmgr.exe`}
+	if err = handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils); err != nil {
+		t.Fatal(err)
+	}
+	checkErrors(callCounter, t)
+	if calls := callCounter["sendData"]; len(calls) < 1 || !bytes.Equal(calls[0]["data"].([]byte), []byte{42}) {
+		t.Error("Expected the remapped file to be sent")
+	}
+
+	p = PacketRequest{Op: OpWRQ, Mode: "octet", Filename: `\boot\x86\bootmgr.exe`}
+	handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+	if calls := callCounter["sendError"]; len(calls) < 1 || calls[0]["code"] != uint16(2) {
+		t.Errorf("Expected the write to be refused with error 2, got %v", calls)
+	}
+}
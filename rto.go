@@ -0,0 +1,111 @@
+package tftp
+
+import "time"
+
+// Without the timeout option, the retransmission timeout adapts to the
+// round trip time measured during the transfer, as TCP's does (RFC 6298).
+// It starts at initialRTO, and stays between a floor and a ceiling,
+// which default to defaultMinRTO and defaultMaxRTO.
+const (
+	initialRTO    = time.Second
+	defaultMinRTO = 200 * time.Millisecond
+	defaultMaxRTO = defaultTimeout
+	// rtoGranularity is the clock granularity, G in RFC 6298
+	rtoGranularity = time.Millisecond
+)
+
+// retransmitTimer decides how long to wait for a response before resending
+// a packet.  One is shared by every exchange in a transfer, so it learns
+// the round trip time of the path to the peer.
+type retransmitTimer struct {
+	// srtt and rttvar are the smoothed round trip time and its variation
+	srtt   time.Duration
+	rttvar time.Duration
+	// measured is false until the first round trip time is sampled
+	measured bool
+
+	rto     time.Duration
+	floor   time.Duration
+	ceiling time.Duration
+	// fixed timers, set by the timeout option, never adapt
+	fixed bool
+}
+
+// newRetransmitTimer returns a timer that adapts to the measured round
+// trip time, staying between floor and ceiling.
+func newRetransmitTimer(floor, ceiling time.Duration) *retransmitTimer {
+	t := &retransmitTimer{floor: floor, ceiling: ceiling}
+	t.set(initialRTO)
+	return t
+}
+
+// fixedTimer returns a timer that always waits for timeout.
+func fixedTimer(timeout time.Duration) *retransmitTimer {
+	return &retransmitTimer{rto: timeout, floor: timeout, ceiling: timeout, fixed: true}
+}
+
+// timeout returns how long to wait for the next response.
+func (t *retransmitTimer) timeout() time.Duration {
+	return t.rto
+}
+
+// limit changes the floor and ceiling of an adaptive timer.
+// A zero value leaves that bound unchanged.
+func (t *retransmitTimer) limit(floor, ceiling time.Duration) {
+	if t.fixed {
+		return
+	}
+	if floor > 0 {
+		t.floor = floor
+	}
+	if ceiling > 0 {
+		t.ceiling = ceiling
+	}
+	t.set(t.rto)
+}
+
+// sample updates the timeout with the round trip time of a packet that
+// was answered without being resent.  Following Karn's algorithm, resent
+// packets are never sampled, as it is unclear which copy was answered.
+func (t *retransmitTimer) sample(rtt time.Duration) {
+	if t.fixed {
+		return
+	}
+	if !t.measured {
+		t.srtt = rtt
+		t.rttvar = rtt / 2
+		t.measured = true
+	} else {
+		delta := t.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		// beta is 1/4, and alpha is 1/8
+		t.rttvar = (3*t.rttvar + delta) / 4
+		t.srtt = (7*t.srtt + rtt) / 8
+	}
+	variance := 4 * t.rttvar
+	if variance < rtoGranularity {
+		variance = rtoGranularity
+	}
+	t.set(t.srtt + variance)
+}
+
+// backoff doubles the timeout after a response fails to arrive.
+func (t *retransmitTimer) backoff() {
+	if t.fixed {
+		return
+	}
+	t.set(2 * t.rto)
+}
+
+// set changes the timeout to rto, kept between the floor and the ceiling.
+func (t *retransmitTimer) set(rto time.Duration) {
+	if rto < t.floor {
+		rto = t.floor
+	}
+	if rto > t.ceiling {
+		rto = t.ceiling
+	}
+	t.rto = rto
+}
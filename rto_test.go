@@ -0,0 +1,112 @@
+package tftp
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRetransmitTimerSample(t *testing.T) {
+	timer := newRetransmitTimer(time.Millisecond, time.Minute)
+	if timer.timeout() != initialRTO {
+		t.Errorf("Expected initial timeout of %v, got %v", initialRTO, timer.timeout())
+	}
+
+	// the first sample sets the variation to half the round trip time
+	timer.sample(100 * time.Millisecond)
+	if timer.timeout() != 300*time.Millisecond {
+		t.Errorf("Expected 300ms after the first sample, got %v", timer.timeout())
+	}
+
+	// later samples are smoothed
+	timer.sample(100 * time.Millisecond)
+	if timer.srtt != 100*time.Millisecond || timer.rttvar != 37500*time.Microsecond {
+		t.Errorf("Expected srtt 100ms and rttvar 37.5ms, got %v and %v", timer.srtt, timer.rttvar)
+	}
+	if timer.timeout() != 250*time.Millisecond {
+		t.Errorf("Expected 250ms after the second sample, got %v", timer.timeout())
+	}
+	timer.sample(200 * time.Millisecond)
+	if timer.srtt != 112500*time.Microsecond {
+		t.Errorf("Expected srtt to move an eighth of the way to 200ms, got %v", timer.srtt)
+	}
+}
+
+func TestRetransmitTimerBounds(t *testing.T) {
+	timer := newRetransmitTimer(50*time.Millisecond, 2*time.Second)
+
+	// a fast network still waits for the floor
+	timer.sample(time.Microsecond)
+	if timer.timeout() != 50*time.Millisecond {
+		t.Errorf("Expected the 50ms floor, got %v", timer.timeout())
+	}
+
+	// backing off doubles the timeout, up to the ceiling
+	expected := []time.Duration{100, 200, 400, 800, 1600, 2000, 2000}
+	for _, ms := range expected {
+		timer.backoff()
+		if timer.timeout() != ms*time.Millisecond {
+			t.Errorf("Expected %dms after backing off, got %v", ms, timer.timeout())
+		}
+	}
+
+	timer.limit(0, time.Second)
+	if timer.timeout() != time.Second {
+		t.Errorf("Expected a lower ceiling to cut the timeout to 1s, got %v", timer.timeout())
+	}
+}
+
+func TestFixedTimer(t *testing.T) {
+	timer := fixedTimer(3 * time.Second)
+	timer.sample(time.Millisecond)
+	timer.backoff()
+	timer.limit(time.Millisecond, time.Second)
+	if timer.timeout() != 3*time.Second {
+		t.Errorf("Expected a fixed timeout of 3s, got %v", timer.timeout())
+	}
+}
+
+func TestNegotiatedTimer(t *testing.T) {
+	if s := negotiatedSettings(map[string]string{"timeout": "4"}); !s.rto.fixed || s.rto.timeout() != 4*time.Second {
+		t.Errorf("Expected the timeout option to fix the timeout at 4s, got %+v", s.rto)
+	}
+	if s := negotiatedSettings(nil); s.rto.fixed || s.rto.floor != defaultMinRTO || s.rto.ceiling != defaultMaxRTO {
+		t.Errorf("Expected an adaptive timeout by default, got %+v", s.rto)
+	}
+}
+
+func TestExchangeBacksOff(t *testing.T) {
+	conn := NewPacketConn()
+	timer := newRetransmitTimer(20*time.Millisecond, time.Second)
+	timer.set(20 * time.Millisecond)
+	success := func(Packet) bool {
+		return true
+	}
+	requestPacket := PacketAck{BlockNum: 7}
+	done := make(chan error)
+	go func() {
+		_, _, err := sendAndWait(context.Background(), &conn.Server, &requestPacket, timer, 0, success, &net.UDPAddr{})
+		done <- err
+	}()
+
+	// ignore the first two sends, then answer the third
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		ReadAckPacket(t, &conn.Client)
+	}
+	elapsed := time.Since(start)
+	conn.Client.WriteTo(requestPacket.Serialize(), &net.UDPAddr{})
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// waiting 20ms and then 40ms
+	if elapsed < 60*time.Millisecond {
+		t.Errorf("Expected resends to back off, but they took %v", elapsed)
+	}
+	// a response to a resent packet is not sampled
+	if timer.measured || timer.timeout() != 80*time.Millisecond {
+		t.Errorf("Expected the backed off timeout of 80ms to stand, got %v", timer.timeout())
+	}
+}
@@ -0,0 +1,342 @@
+package tftp
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned by Serve and ListenAndServe
+// once Shutdown has been called.
+var ErrServerClosed = errors.New("tftp: Server closed")
+
+// Server answers TFTP requests, handing each to its own goroutine, in
+// the manner of net/http's Server.  The zero value refuses every request,
+// until ServerConfig is given a Store, or handlers.
+type Server struct {
+	// ServerConfig holds the store and the settings for each transfer.
+	ServerConfig
+
+	// ErrorLog records requests that fail.  If nil, the log package's
+	// standard logger is used.
+	ErrorLog *log.Logger
+
+	// Limits caps the transfers and requests the server accepts.
+	Limits Limits
+
+	// SinglePort sends every transfer from the port its request was sent
+	// to, rather than a port of its own, and tells the packets of
+	// different transfers apart by the client's address.  It suits
+	// networks where only that port is reachable, such as containers that
+	// publish port 69 alone, or clients behind strict firewalls.
+	SinglePort bool
+
+	// handle processes a single request, sending the transfer through the
+	// PacketConn that open returns.  It is replaced in tests.
+	handle func(ctx context.Context, buf []byte, addr net.UDPAddr, config *ServerConfig, open func() (net.PacketConn, error)) error
+
+	limiter    limiter
+	duplicates duplicates
+
+	mu sync.Mutex
+	// listeners maps each listener to whether it is shared by transfers
+	listeners  map[net.PacketConn]bool
+	shared     map[string]*sharedConn
+	transfers  sync.WaitGroup
+	ctx        context.Context
+	cancel     context.CancelFunc
+	inShutdown bool
+}
+
+// ListenAndServe listens on the UDP address addr, and calls Serve.
+// If addr is empty, ":69" is used.  An address with no host listens on
+// every address, IPv4 and IPv6 where the system is dual-stack, while
+// 0.0.0.0 and [::] listen on every address of one family alone.  To
+// listen on several addresses, call ListenAndServe, or Serve, for each.
+func (s *Server) ListenAndServe(addr string) error {
+	if addr == "" {
+		addr = ":69"
+	}
+	conn, err := net.ListenPacket(listenNetwork(addr), addr)
+	if err != nil {
+		return err
+	}
+	return s.Serve(conn)
+}
+
+// listenNetwork returns the network to listen on addr with, which is
+// limited to one family if addr has an IP address for a host.
+func listenNetwork(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "udp"
+	}
+	if i := strings.LastIndex(host, "%"); i >= 0 {
+		// an IPv6 address with a zone
+		host = host[:i]
+	}
+	ip := net.ParseIP(host)
+	switch {
+	case ip == nil:
+		return "udp"
+	case ip.To4() != nil:
+		return "udp4"
+	}
+	return "udp6"
+}
+
+// Serve reads requests from conn, and starts a transfer for each, from a
+// port of its own, or through conn in single port mode.  It closes conn
+// when it returns, which is always with an error, and with ErrServerClosed
+// after Shutdown.
+func (s *Server) Serve(conn net.PacketConn) error {
+	singlePort := s.SinglePort
+	ctx, ok := s.track(conn, singlePort)
+	defer s.untrack(conn)
+	if !ok {
+		conn.Close()
+		return ErrServerClosed
+	}
+	handle := s.handle
+	if handle == nil {
+		handle = handleReq
+	}
+	for {
+		// Wait for a request.
+		buf := make([]byte, MaxPacketSize)
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			conn.Close()
+			return err
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			s.logf("Ignoring request from %s, which is not a UDP address", addr.String())
+			continue
+		}
+		if singlePort && s.route(udpAddr, buf[:n]) {
+			continue
+		}
+		if !isRequest(buf[:n]) {
+			// a stray packet, such as one from a transfer that is over,
+			// mustn't be taken for a request
+			if singlePort {
+				rejectStranger(conn, buf[:n], udpAddr)
+			} else {
+				s.logf("Ignoring packet from %s, which is not a request", udpAddr.String())
+			}
+			continue
+		}
+		// a client that hears nothing back resends its request,
+		// which mustn't start a second transfer
+		request := PacketRequest{}
+		var key *requestKey
+		if request.Parse(buf[:n]) == nil {
+			key = &requestKey{addr: udpAddr.String(), op: request.Op, filename: request.Filename}
+			if !s.duplicates.start(*key, time.Now()) {
+				OpLogger.Printf("Ignoring duplicate request from %s for %s", udpAddr.String(), request.Filename)
+				continue
+			}
+		}
+		if err := s.limiter.admit(s.Limits, udpAddr.IP, time.Now()); err != nil {
+			OpLogger.Printf("Refused request from %s: %s", udpAddr.String(), err.Error())
+			writeError(conn, 0, err.Error(), udpAddr)
+			if key != nil {
+				s.duplicates.forget(*key)
+			}
+			continue
+		}
+		if !s.startTransfer() {
+			s.limiter.release(udpAddr.IP)
+			if key != nil {
+				s.duplicates.forget(*key)
+			}
+			if singlePort {
+				// keep routing packets to the transfers still active
+				continue
+			}
+			return ErrServerClosed
+		}
+		open := func() (net.PacketConn, error) {
+			return s.ServerConfig.listenTransferPort(conn.LocalAddr())
+		}
+		var shared *sharedConn
+		if singlePort {
+			// registered now, so the client's next packet reaches it
+			shared = s.share(conn, udpAddr)
+			open = func() (net.PacketConn, error) {
+				return shared, nil
+			}
+		}
+		// Handle the request in go routine, allowing
+		// the main thread to keep accepting new connections.
+		go func() {
+			defer s.transfers.Done()
+			defer s.limiter.release(udpAddr.IP)
+			if shared != nil {
+				// in case the request failed before the transfer began
+				defer shared.Close()
+			}
+			err := handle(ctx, buf[:n], *udpAddr, &s.ServerConfig, open)
+			if err != nil {
+				s.logf("Transfer for %s failed: %s", udpAddr.String(), err.Error())
+			}
+			s.end(key, err)
+		}()
+	}
+}
+
+// Shutdown stops the server gracefully.  It closes every listener, so no
+// more requests are accepted, and then waits for active transfers to
+// finish.  If ctx is done first, the remaining transfers are cancelled,
+// which sends their clients an ERROR packet, and ctx.Err() is returned.
+// In single port mode, the listeners carry the transfers, so they stay
+// open, ignoring new requests, until the transfers are over.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.inShutdown = true
+	for conn, shared := range s.listeners {
+		if !shared {
+			conn.Close()
+		}
+	}
+	s.mu.Unlock()
+	defer s.closeListeners()
+
+	finished := make(chan struct{})
+	go func() {
+		s.transfers.Wait()
+		close(finished)
+	}()
+	select {
+	case <-finished:
+		return nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		if s.cancel != nil {
+			s.cancel()
+		}
+		s.mu.Unlock()
+		<-finished
+		return ctx.Err()
+	}
+}
+
+// track adds conn to the listeners closed by Shutdown, and returns the
+// context for transfers, or false if the server has been shut down.
+func (s *Server) track(conn net.PacketConn, shared bool) (context.Context, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown {
+		return nil, false
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.PacketConn]bool)
+	}
+	s.listeners[conn] = shared
+	if s.ctx == nil {
+		s.ctx, s.cancel = context.WithCancel(context.Background())
+	}
+	return s.ctx, true
+}
+
+func (s *Server) untrack(conn net.PacketConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.listeners, conn)
+}
+
+func (s *Server) closeListeners() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.listeners {
+		conn.Close()
+	}
+}
+
+// share registers a transfer for the client at addr, in single port mode,
+// whose packets are read from conn.
+func (s *Server) share(conn net.PacketConn, addr *net.UDPAddr) *sharedConn {
+	key := addr.String()
+	var shared *sharedConn
+	shared = newSharedConn(conn, addr, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.shared[key] == shared {
+			delete(s.shared, key)
+		}
+	})
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.shared == nil {
+		s.shared = make(map[string]*sharedConn)
+	}
+	s.shared[key] = shared
+	return shared
+}
+
+// route passes b to the transfer for the client at addr, in single port
+// mode, and reports whether there is one.
+func (s *Server) route(addr *net.UDPAddr, b []byte) bool {
+	s.mu.Lock()
+	shared, ok := s.shared[addr.String()]
+	s.mu.Unlock()
+	if ok {
+		shared.deliver(b)
+	}
+	return ok
+}
+
+// isRequest reports whether b has the opcode of a read or write request.
+func isRequest(b []byte) bool {
+	op, _, err := parseUint16(b)
+	return err == nil && (op == OpRRQ || op == OpWRQ)
+}
+
+// startTransfer counts a new transfer for Shutdown to wait for,
+// unless the server is shutting down.
+func (s *Server) startTransfer() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inShutdown {
+		return false
+	}
+	s.transfers.Add(1)
+	return true
+}
+
+// end lets the duplicates of the request key, if any, be forgotten soon,
+// or at once if the client ended the transfer with an ERROR packet, as it
+// has given up on the request and won't be retransmitting it.  A handler
+// refusing the request with a *PacketError doesn't count.
+func (s *Server) end(key *requestKey, err error) {
+	if key == nil {
+		return
+	}
+	if remote, ok := err.(*PacketError); ok && remote.fromPeer {
+		s.duplicates.forget(*key)
+	} else {
+		s.duplicates.end(*key, time.Now())
+	}
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inShutdown
+}
+
+func (s *Server) logf(format string, args ...interface{}) {
+	if s.ErrorLog != nil {
+		s.ErrorLog.Printf(format, args...)
+	} else {
+		log.Printf(format, args...)
+	}
+}
@@ -0,0 +1,353 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+)
+
+// newTestServer returns a server whose transfers are handled by handle,
+// and a channel reporting when each one starts
+func newTestServer(handle func(ctx context.Context) error) (*Server, chan PacketRequest) {
+	started := make(chan PacketRequest, 1)
+	s := &Server{ServerConfig: *newTestConfig()}
+	s.handle = func(ctx context.Context, buf []byte, addr net.UDPAddr, config *ServerConfig, open func() (net.PacketConn, error)) error {
+		p := PacketRequest{}
+		p.Parse(buf)
+		started <- p
+		return handle(ctx)
+	}
+	return s, started
+}
+
+func TestServeShutdown(t *testing.T) {
+	conn := NewPacketConn()
+	release := make(chan struct{})
+	s, started := newTestServer(func(ctx context.Context) error {
+		<-release
+		return nil
+	})
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(&conn.Server)
+	}()
+
+	request := PacketRequest{Op: OpRRQ, Filename: "foo", Mode: "octet"}
+	conn.Client.WriteTo(request.Serialize(), nil)
+	if p := <-started; p.Filename != "foo" {
+		t.Errorf("Expected a transfer of foo, got %+v", p)
+	}
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+	}
+	select {
+	case <-shutdown:
+		t.Error("Shutdown returned before the transfer finished")
+	case <-time.After(10 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+
+	// the server can't be restarted
+	other := NewPacketConn()
+	if err := s.Serve(&other.Server); err != ErrServerClosed {
+		t.Errorf("Expected Serve after Shutdown to return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestShutdownCancelsTransfers(t *testing.T) {
+	conn := NewPacketConn()
+	s, started := newTestServer(func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	go s.Serve(&conn.Server)
+
+	request := PacketRequest{Op: OpWRQ, Filename: "foo", Mode: "octet"}
+	conn.Client.WriteTo(request.Serialize(), nil)
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("Expected Shutdown to give up on the transfer, got %v", err)
+	}
+}
+
+func TestServeIgnoresStrayPackets(t *testing.T) {
+	for _, singlePort := range []bool{false, true} {
+		conn := NewPacketConn()
+		s, started := newTestServer(func(ctx context.Context) error {
+			return nil
+		})
+		s.SinglePort = singlePort
+		go s.Serve(&conn.Server)
+
+		// neither should start a transfer
+		ack := PacketAck{BlockNum: 0}
+		data := PacketData{BlockNum: 1, Data: []byte("foo\x00octet\x00")}
+		for _, p := range []Packet{&ack, &data} {
+			conn.Client.WriteTo(p.Serialize(), nil)
+			if singlePort {
+				readError(t, &conn.Client, 5)
+			}
+		}
+		request := PacketRequest{Op: OpRRQ, Filename: "foo", Mode: "octet"}
+		conn.Client.WriteTo(request.Serialize(), nil)
+		if p := <-started; p.Filename != "foo" {
+			t.Errorf("Expected only the request to start a transfer, got %+v (single port %v)", p, singlePort)
+		}
+		s.Shutdown(context.Background())
+	}
+}
+
+func TestServeRoundTrip(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't listen on loopback: %v", err)
+	}
+	s := &Server{ServerConfig: *newTestConfig()}
+	go s.Serve(listener)
+	defer s.Shutdown(context.Background())
+
+	value := bytes.Join(generateTestData(3, 10), nil)
+	client := &Client{TransferSize: true}
+	addr := listener.LocalAddr().String()
+	if err = client.Put(context.Background(), addr, "foo", bytes.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	var result bytes.Buffer
+	if err = client.Get(context.Background(), addr, "foo", &result); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Bytes(), value) {
+		t.Error("Data corruption detected.")
+	}
+}
+
+func TestListenNetwork(t *testing.T) {
+	var tests = []struct {
+		addr     string
+		expected string
+	}{
+		{":69", "udp"},
+		{"localhost:69", "udp"},
+		{"0.0.0.0:69", "udp4"},
+		{"192.0.2.1:69", "udp4"},
+		{"[::]:69", "udp6"},
+		{"[2001:db8::1]:69", "udp6"},
+		{"[fe80::1%eth0]:69", "udp6"},
+		{"garbage", "udp"},
+	}
+	for _, test := range tests {
+		if actual := listenNetwork(test.addr); actual != test.expected {
+			t.Errorf("%s: expected %s, got %s", test.addr, test.expected, actual)
+		}
+	}
+}
+
+func TestTransferAddr(t *testing.T) {
+	var tests = []struct {
+		local    net.Addr
+		network  string
+		expected string
+	}{
+		{nil, "udp", ":0"},
+		{&net.UDPAddr{Port: 69}, "udp", ":0"},
+		{&net.UDPAddr{IP: net.IPv4zero, Port: 69}, "udp4", ":0"},
+		{&net.UDPAddr{IP: net.IPv6unspecified, Port: 69}, "udp", ":0"},
+		{&net.UDPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 69}, "udp4", "192.0.2.1:0"},
+		{&net.UDPAddr{IP: net.ParseIP("2001:db8::1"), Port: 69}, "udp6", "[2001:db8::1]:0"},
+		{&net.UDPAddr{IP: net.ParseIP("fe80::1"), Port: 69, Zone: "eth0"}, "udp6", "[fe80::1%eth0]:0"},
+	}
+	for _, test := range tests {
+		network, addr := transferAddr(test.local)
+		if network != test.network || addr.String() != test.expected {
+			t.Errorf("%v: expected %s %s, got %s %s", test.local, test.network, test.expected, network, addr.String())
+		}
+	}
+}
+
+// testRoundTrip serves a store on the UDP address addr, and checks a file
+// survives the trip there and back, with every packet from the server
+// coming from an address with host.
+func testRoundTrip(t *testing.T, s *Server, addr string, host string) {
+	listener, err := net.ListenPacket(listenNetwork(addr), addr)
+	if err != nil {
+		t.Skipf("Can't listen on %s: %v", addr, err)
+	}
+	go s.Serve(listener)
+	defer s.Shutdown(context.Background())
+	addr = listener.LocalAddr().String()
+
+	client := &Client{
+		ListenPacket: func() (net.PacketConn, error) {
+			conn, err := net.ListenPacket("udp", "")
+			return &hostChecker{PacketConn: conn, t: t, host: host}, err
+		},
+		TransferSize: true,
+		WindowSize:   4,
+	}
+	value := bytes.Join(generateTestData(20, 10), nil)
+	if err = client.Put(context.Background(), addr, "foo", bytes.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	var result bytes.Buffer
+	if err = client.Get(context.Background(), addr, "foo", &result); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Bytes(), value) {
+		t.Error("Data corruption detected.")
+	}
+}
+
+// hostChecker fails the test if a packet comes from any host but host
+type hostChecker struct {
+	net.PacketConn
+	t    *testing.T
+	host string
+}
+
+func (c *hostChecker) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil {
+		if host, _, _ := net.SplitHostPort(addr.String()); host != c.host {
+			c.t.Errorf("Expected packets from %s, got one from %s", c.host, addr.String())
+		}
+	}
+	return n, addr, err
+}
+
+func TestHandleReqLocalAddr(t *testing.T) {
+	// a transfer socket on every address would answer from 127.0.0.1,
+	// the address the client's packets are routed from
+	listener, err := net.ListenPacket("udp4", "127.0.0.2:0")
+	if err != nil {
+		t.Skipf("Can't listen on 127.0.0.2: %v", err)
+	}
+	defer listener.Close()
+	config := newTestConfig()
+	setTestData(t, config.Store, "foo", []byte("bar"))
+	go func() {
+		buf := make([]byte, MaxPacketSize)
+		n, addr, err := listener.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		HandleReq(context.Background(), buf[:n], *addr.(*net.UDPAddr), listener.LocalAddr(), config)
+	}()
+
+	client := &Client{
+		ListenPacket: func() (net.PacketConn, error) {
+			conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+			return &hostChecker{PacketConn: conn, t: t, host: "127.0.0.2"}, err
+		},
+	}
+	var result bytes.Buffer
+	if err = client.Get(context.Background(), listener.LocalAddr().String(), "foo", &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.String() != "bar" {
+		t.Errorf("Expected bar, got %q", result.String())
+	}
+}
+
+func TestServeIPv6(t *testing.T) {
+	testRoundTrip(t, &Server{ServerConfig: *newTestConfig()}, "[::1]:0", "::1")
+}
+
+func TestServeIPv6SinglePort(t *testing.T) {
+	testRoundTrip(t, &Server{ServerConfig: *newTestConfig(), SinglePort: true}, "[::1]:0", "::1")
+}
+
+func TestServeIPv6PortRange(t *testing.T) {
+	s := &Server{ServerConfig: *newTestConfig()}
+	s.MinPort, s.MaxPort = 40000, 40999
+	testRoundTrip(t, s, "[::1]:0", "::1")
+}
+
+func TestServeSeveralAddresses(t *testing.T) {
+	s := &Server{ServerConfig: *newTestConfig()}
+	v4, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't listen on loopback: %v", err)
+	}
+	v6, err := net.ListenPacket("udp6", "[::1]:0")
+	if err != nil {
+		v4.Close()
+		t.Skipf("Can't listen on IPv6 loopback: %v", err)
+	}
+	go s.Serve(v4)
+	go s.Serve(v6)
+	defer s.Shutdown(context.Background())
+
+	// a file written over one family can be read over the other
+	value := bytes.Join(generateTestData(3, 10), nil)
+	client := &Client{}
+	if err = client.Put(context.Background(), v4.LocalAddr().String(), "foo", bytes.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+	var result bytes.Buffer
+	if err = client.Get(context.Background(), v6.LocalAddr().String(), "foo", &result); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(result.Bytes(), value) {
+		t.Error("Data corruption detected.")
+	}
+}
+
+// failingWriter is a FileWriter for a full disk
+type failingWriter struct {
+	failingIO
+}
+
+func (failingWriter) Commit() error { return nil }
+func (failingWriter) Abort() error  { return nil }
+
+func TestServeReportsStorageErrors(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't listen on loopback: %v", err)
+	}
+	s := &Server{}
+	s.ReadHandler = ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+		return ioutil.NopCloser(failingIO{}), -1, nil
+	})
+	s.WriteHandler = WriteHandlerFunc(func(ctx context.Context, r *Request) (FileWriter, error) {
+		return failingWriter{}, nil
+	})
+	for _, singlePort := range []bool{false, true} {
+		s.SinglePort = singlePort
+		conn := listener
+		if singlePort {
+			if conn, err = net.ListenPacket("udp", "127.0.0.1:0"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		go s.Serve(conn)
+		addr := conn.LocalAddr().String()
+
+		// the client hears why, rather than timing out
+		client := &Client{Retries: 1}
+		err = client.Put(context.Background(), addr, "foo", bytes.NewReader([]byte{1, 2, 3}))
+		if e, ok := err.(*PacketError); !ok || e.Code != 3 {
+			t.Errorf("Single port %t: expected error 3 from Put, got %v", singlePort, err)
+		}
+		err = client.Get(context.Background(), addr, "foo", &bytes.Buffer{})
+		if e, ok := err.(*PacketError); !ok || e.Code != 0 {
+			t.Errorf("Single port %t: expected error 0 from Get, got %v", singlePort, err)
+		}
+	}
+	s.Shutdown(context.Background())
+}
@@ -1,16 +1,171 @@
 package tftp
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math/rand"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 )
 
 /// this file contains types and functions particular to the tftp server
 
-var store = MapDataStore{mapStore: make(map[string][][]byte)}
+// ServerConfig holds the settings for a single server, so that
+// several servers can run in one process, each with their own store.
+type ServerConfig struct {
+	// Store is where files are read from and written to,
+	// unless ReadHandler or WriteHandler is set.
+	Store Datastore
+
+	// ReadHandler, if set, provides the files clients read, in place of Store.
+	ReadHandler ReadHandler
+
+	// WriteHandler, if set, receives the files clients write, in place of Store.
+	WriteHandler WriteHandler
+
+	// Middleware wraps the handlers, or the handlers for Store, in layers.
+	// The first layer is the outermost, so it sees each request first.
+	Middleware []Middleware
+
+	// MaxFileSize is the largest file, in bytes, a client may declare with
+	// the tsize option when writing.  Zero means there is no limit.
+	MaxFileSize int64
+
+	// NetasciiCanonical controls how files written in netascii mode are
+	// stored.  By default they are converted to local text, with lines
+	// ending in LF, and converted back when read in netascii mode.  When
+	// true, they are stored in the canonical netascii form they were sent
+	// in, and sent back unchanged.
+	NetasciiCanonical bool
+
+	// MaxWindowSize caps the windowsize option, as a whole window of blocks
+	// is held in memory while it is sent.  A client asking for more is
+	// offered MaxWindowSize instead.  Zero means DefaultMaxWindowSize.
+	MaxWindowSize int
+
+	// Retries is how many times a packet is resent to a client that has
+	// stopped responding, before the transfer is abandoned.
+	// Zero means DefaultRetries.
+	Retries int
+
+	// MinTimeout and MaxTimeout bound the retransmission timeout, which
+	// adapts to the round trip time measured during each transfer, unless
+	// the client fixes it with the timeout option.  Zero means 200
+	// milliseconds and 10 seconds respectively.
+	MinTimeout time.Duration
+	MaxTimeout time.Duration
+
+	// MinPort and MaxPort bound the ports each transfer is sent from, for
+	// firewalls that only let a range through.  Zero means any port the
+	// system picks.
+	MinPort int
+	MaxPort int
+}
+
+// readHandler returns the handler for reads, wrapped in the middleware,
+// or nil if there is none.
+func (c *ServerConfig) readHandler() ReadHandler {
+	var h ReadHandler
+	if c.ReadHandler != nil {
+		h = c.ReadHandler
+	} else if c.Store != nil {
+		h = StoreHandler{c.Store}
+	} else {
+		return nil
+	}
+	return wrapRead(h, c.Middleware)
+}
+
+// writeHandler returns the handler for writes, wrapped in the middleware,
+// or nil if there is none.
+func (c *ServerConfig) writeHandler() WriteHandler {
+	var h WriteHandler
+	if c.WriteHandler != nil {
+		h = c.WriteHandler
+	} else if c.Store != nil {
+		h = StoreHandler{c.Store}
+	} else {
+		return nil
+	}
+	return wrapWrite(h, c.Middleware)
+}
+
+// retries returns the number of resends allowed in each transfer.
+func (c *ServerConfig) retries() int {
+	if c.Retries > 0 {
+		return c.Retries
+	}
+	return DefaultRetries
+}
+
+func (c *ServerConfig) maxWindowSize() int {
+	if c.MaxWindowSize > 0 {
+		return c.MaxWindowSize
+	}
+	return DefaultMaxWindowSize
+}
+
+// limitWindowSize counter-offers the largest window size allowed, if the
+// client asked for more.
+func (c *ServerConfig) limitWindowSize(options map[string]string) {
+	if value, ok := options["windowsize"]; ok {
+		if size, _ := strconv.Atoi(value); size > c.maxWindowSize() {
+			options["windowsize"] = strconv.Itoa(c.maxWindowSize())
+		}
+	}
+}
+
+// listenTransferPort opens the socket for a transfer, on a free port in
+// the range MinPort to MaxPort, if one is set.  It tries the ports from a
+// random place in the range, so concurrent transfers rarely collide.  The
+// socket has the address family and IP of local, the address the request
+// was received on, if it is bound to one, so the client hears back from
+// the address it sent to.
+func (c *ServerConfig) listenTransferPort(local net.Addr) (net.PacketConn, error) {
+	network, addr := transferAddr(local)
+	if c.MinPort <= 0 || c.MaxPort < c.MinPort {
+		return net.ListenUDP(network, addr)
+	}
+	count := c.MaxPort - c.MinPort + 1
+	start := rand.Intn(count)
+	for i := 0; i < count; i++ {
+		addr.Port = c.MinPort + (start+i)%count
+		if conn, err := net.ListenUDP(network, addr); err == nil {
+			return conn, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port between %d and %d", c.MinPort, c.MaxPort)
+}
+
+// transferAddr returns the network and address to open a transfer's
+// socket on, for a request received on local.  A listener on every
+// address gets a transfer socket on every address, of the same family,
+// or of both if it is dual-stack.
+func transferAddr(local net.Addr) (string, *net.UDPAddr) {
+	addr := &net.UDPAddr{}
+	udpAddr, ok := local.(*net.UDPAddr)
+	if !ok || udpAddr.IP == nil {
+		return "udp", addr
+	}
+	network := "udp6"
+	if udpAddr.IP.To4() != nil {
+		network = "udp4"
+	}
+	if udpAddr.IP.IsUnspecified() {
+		if network == "udp6" {
+			// [::] is usually dual-stack
+			network = "udp"
+		}
+		return network, addr
+	}
+	addr.IP, addr.Zone = udpAddr.IP, udpAddr.Zone
+	return network, addr
+}
 
 // ServerDependencies makes more sence as an interface, but
 // interfaces cannot be anonymously implemented, while structs
@@ -18,35 +173,53 @@ var store = MapDataStore{mapStore: make(map[string][][]byte)}
 type ServerDependencies struct {
 	openRandomSendPort func() (net.PacketConn, error)
 	sendError          func(conn net.PacketConn, code uint16, message string, dest net.Addr)
-	handleRead         func(conn net.PacketConn, p PacketRequest, addr net.Addr)
-	handleWrite        func(conn net.PacketConn, p PacketRequest, addr net.Addr)
+	handleRead         func(ctx context.Context, conn net.PacketConn, p PacketRequest, addr net.Addr) error
+	handleWrite        func(ctx context.Context, conn net.PacketConn, p PacketRequest, addr net.Addr) error
 }
 
 // UtilDependencies allows dependency injection into utils.go
 type UtilDependencies struct {
-	sendData    func(conn net.PacketConn, data [][]byte, timeout time.Duration, dest net.Addr)
-	receiveData func(conn net.PacketConn, timeout time.Duration, dest net.Addr) [][]byte
+	sendOACK    func(ctx context.Context, conn net.PacketConn, options map[string]string, s transferSettings, dest net.Addr) error
+	sendData    func(ctx context.Context, conn net.PacketConn, r io.Reader, s transferSettings, dest net.Addr) error
+	receiveData func(ctx context.Context, conn net.PacketConn, start Packet, w io.Writer, s transferSettings, dest net.Addr) error
 	sendError   func(conn net.PacketConn, code uint16, message string, dest net.Addr)
 }
 
 // HandleReq processes a particular TFTP connection from start to finish
-// using production dependencies.
-func HandleReq(buf []byte, addr net.UDPAddr) {
+// using production dependencies, and the settings in config.  It returns
+// the reason the transfer failed, which is a *TimeoutError if the client
+// stopped responding.  If ctx is done before the transfer is, the client is
+// sent an ERROR packet, and ctx.Err() is returned.  local is the address
+// the request was received on, the LocalAddr of the listener, so the
+// transfer is sent from the same IP address and family.
+func HandleReq(ctx context.Context, buf []byte, addr net.UDPAddr, local net.Addr, config *ServerConfig) error {
+	return handleReq(ctx, buf, addr, config, func() (net.PacketConn, error) {
+		return config.listenTransferPort(local)
+	})
+}
+
+// handleReq is HandleReq, with the transfer sent through the PacketConn
+// that open returns, as it is in single port mode.
+func handleReq(ctx context.Context, buf []byte, addr net.UDPAddr, config *ServerConfig, open func() (net.PacketConn, error)) error {
 	// These objects just inject the functions for production use
 	productionUtils := UtilDependencies{
-		sendData: func(conn net.PacketConn, data [][]byte, timeout time.Duration, dest net.Addr) {
-			sendData(conn, data, timeout, dest)
+		sendOACK: func(ctx context.Context, conn net.PacketConn, options map[string]string, s transferSettings, dest net.Addr) error {
+			return sendOACK(ctx, conn, options, s, dest)
 		},
-		receiveData: func(conn net.PacketConn, timeout time.Duration, dest net.Addr) [][]byte {
-			return receiveData(conn, timeout, dest)
+		sendData: func(ctx context.Context, conn net.PacketConn, r io.Reader, s transferSettings, dest net.Addr) error {
+			return sendData(ctx, conn, r, s, dest)
+		},
+		receiveData: func(ctx context.Context, conn net.PacketConn, start Packet, w io.Writer, s transferSettings, dest net.Addr) error {
+			return receiveData(ctx, conn, start, w, s, dest)
 		},
 		sendError: func(conn net.PacketConn, code uint16, message string, dest net.Addr) {
-			sendError(conn, code, message, dest)
+			// the connection is closed as soon as the handler returns
+			writeError(conn, code, message, dest)
 		},
 	}
 	productionDependencies := ServerDependencies{
 		openRandomSendPort: func() (conn net.PacketConn, err error) {
-			conn, err = net.ListenUDP("udp", nil)
+			conn, err = open()
 			// Uncomment to enable detailed debug logs.
 			// conn = &PacketConnLogger{PacketConn: conn}
 			return
@@ -54,65 +227,263 @@ func HandleReq(buf []byte, addr net.UDPAddr) {
 		sendError: func(conn net.PacketConn, code uint16, message string, dest net.Addr) {
 			productionUtils.sendError(conn, code, message, dest)
 		},
-		handleRead: func(conn net.PacketConn, p PacketRequest, addr net.Addr) {
-			handleRead(conn, p, addr, productionUtils)
+		handleRead: func(ctx context.Context, conn net.PacketConn, p PacketRequest, addr net.Addr) error {
+			return handleRead(ctx, conn, p, addr, config, productionUtils)
 		},
-		handleWrite: func(conn net.PacketConn, p PacketRequest, addr net.Addr) {
-			handleWrite(conn, p, addr, productionUtils)
+		handleWrite: func(ctx context.Context, conn net.PacketConn, p PacketRequest, addr net.Addr) error {
+			return handleWrite(ctx, conn, p, addr, config, productionUtils)
 		},
 	}
 
-	handleReqDep(buf, addr, productionDependencies)
+	return handleReqDep(ctx, buf, addr, productionDependencies)
 }
 
-func handleReqDep(buf []byte, addr net.UDPAddr, dep ServerDependencies) {
+func handleReqDep(ctx context.Context, buf []byte, addr net.UDPAddr, dep ServerDependencies) error {
 	// TODO: implement recover() here
 	request := PacketRequest{}
 	error := request.Parse(buf)
 	if error != nil {
 		OpLogger.Printf("Received Unrecognized request.")
-		return
+		return error
 	}
 
 	// negotiate new connection using TID
 	conn, error := dep.openRandomSendPort()
-	defer conn.Close()
 	// conn, error := net.ListenUDP("udp", nil)
 	// I don't love passing the client addr to every funciton,
 	// but it allows us to use only the PacketConn interface
 	// which is better
 	if error != nil {
-		dep.sendError(conn, 0, error.Error(), &addr)
+		// without a socket, there is no way to tell the client
+		return error
 	}
-	if !strings.EqualFold(request.Mode, "octet") {
-		dep.sendError(conn, 0, "Only octet mode is supported", &addr) //unsupported mode
-		return
+	defer conn.Close()
+	defer watchContext(ctx, conn)()
+	if !strings.EqualFold(request.Mode, "octet") && !isNetascii(request) {
+		dep.sendError(conn, 0, "Only octet and netascii modes are supported", &addr) //unsupported mode
+		return fmt.Errorf("unsupported mode %s", request.Mode)
 	}
 
+	// from here on, Options holds only what we will acknowledge
+	request.Options = negotiateOptions(request.Options)
+
 	switch request.Op {
 	case OpRRQ:
-		dep.handleRead(conn, request, &addr)
+		return dep.handleRead(ctx, conn, request, &addr)
 	case OpWRQ:
-		dep.handleWrite(conn, request, &addr)
+		return dep.handleWrite(ctx, conn, request, &addr)
 	}
+	return nil
 }
 
-func handleRead(conn net.PacketConn, p PacketRequest, addr net.Addr, dep UtilDependencies) {
+// optionNegotiators holds a function for each option the server understands.
+// Each returns the value to acknowledge, or false if the option should be
+// left out of the OACK.
+var optionNegotiators = map[string]func(value string) (string, bool){
+	"blksize":    negotiateBlockSize,
+	"timeout":    negotiateTimeout,
+	"tsize":      negotiateTransferSize,
+	"windowsize": negotiateWindowSize,
+}
+
+// negotiateBlockSize accepts any block size in the range allowed by RFC 2348,
+// but counter-offers a smaller one if a full data packet would not fit
+// in MaxPacketSize bytes.
+func negotiateBlockSize(value string) (string, bool) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < minBlockSize {
+		return "", false
+	}
+	if size > largestBlockSize() {
+		size = largestBlockSize()
+	}
+	if size < minBlockSize {
+		return "", false
+	}
+	return strconv.Itoa(size), true
+}
+
+// negotiateTimeout accepts the number of seconds allowed by RFC 2349.
+func negotiateTimeout(value string) (string, bool) {
+	seconds, err := strconv.Atoi(value)
+	if err != nil || seconds < minTimeout || seconds > maxTimeout {
+		return "", false
+	}
+	return strconv.Itoa(seconds), true
+}
+
+// negotiateTransferSize accepts any size for now.  The value for a read is
+// filled in by handleRead, and the value for a write is checked by handleWrite,
+// as both depend on the file being transferred.
+func negotiateTransferSize(value string) (string, bool) {
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return "", false
+	}
+	return strconv.FormatInt(size, 10), true
+}
+
+// negotiateWindowSize accepts any window size allowed by RFC 7440.
+func negotiateWindowSize(value string) (string, bool) {
+	size, err := strconv.Atoi(value)
+	if err != nil || size < minWindowSize || size > maxWindowSize {
+		return "", false
+	}
+	return strconv.Itoa(size), true
+}
+
+// negotiateOptions returns the options the server accepts, along with the
+// values it will use for them.  Unknown options are ignored, as RFC 2347
+// requires, so the result is empty if the client should get no OACK.
+func negotiateOptions(requested map[string]string) map[string]string {
+	var accepted map[string]string
+	for name, value := range requested {
+		negotiate, ok := optionNegotiators[name]
+		if !ok {
+			OpLogger.Printf("Ignoring unknown option %s=%s", name, value)
+			continue
+		}
+		if value, ok = negotiate(value); !ok {
+			OpLogger.Printf("Ignoring unacceptable option %s=%s", name, requested[name])
+			continue
+		}
+		if accepted == nil {
+			accepted = make(map[string]string)
+		}
+		accepted[name] = value
+	}
+	return accepted
+}
+
+// isNetascii reports whether p asks for a transfer in netascii mode.
+func isNetascii(p PacketRequest) bool {
+	return strings.EqualFold(p.Mode, "netascii")
+}
+
+// storeError returns the TFTP error code and message for an error from
+// a Datastore or a handler.
+func storeError(err error) (uint16, string) {
+	if remote, ok := err.(*PacketError); ok {
+		return remote.Code, remote.Msg
+	}
+	switch err {
+	case ErrNotFound:
+		return 1, err.Error()
+	case ErrAccessViolation:
+		return 2, err.Error()
+	}
+	return 0, err.Error()
+}
+
+// newRequest describes p, from addr, for a handler.
+func newRequest(p PacketRequest, addr net.Addr) *Request {
+	return &Request{Op: p.Op, Filename: p.Filename, Mode: p.Mode, Options: p.Options, RemoteAddr: addr}
+}
+
+func handleRead(ctx context.Context, conn net.PacketConn, p PacketRequest, addr net.Addr, config *ServerConfig, dep UtilDependencies) error {
 	log.Printf("Processing read request from %s for file %s", addr.String(), p.Filename)
 	OpLogger.Printf("Received read request: %+v", p)
-	if !store.keyExists(p.Filename) {
+	config.limitWindowSize(p.Options)
+	handler := config.readHandler()
+	if handler == nil {
+		dep.sendError(conn, 2, "Reading is not allowed", addr)
+		return ErrAccessViolation
+	}
+	file, size, err := handler.ServeRead(ctx, newRequest(p, addr))
+	if err == ErrNotFound {
 		dep.sendError(conn, 1, fmt.Sprintf("File %s not found", p.Filename), addr)
-		return
+		return err
+	}
+	if err != nil {
+		code, message := storeError(err)
+		dep.sendError(conn, code, message, addr)
+		return err
+	}
+	defer file.Close()
+	var data io.Reader = file
+	if isNetascii(p) && !config.NetasciiCanonical {
+		data = NewNetasciiReader(file)
+		// we can't know how long the file is until it has been converted
+		size = -1
+	}
+	settings := negotiatedSettings(p.Options)
+	settings.retries = config.retries()
+	settings.rto.limit(config.MinTimeout, config.MaxTimeout)
+	// the handler may have kept the request, so its options are left alone
+	oack := make(map[string]string, len(p.Options))
+	for name, value := range p.Options {
+		oack[name] = value
 	}
-	dep.sendData(conn, store.getData(p.Filename), time.Duration(time.Second*10), addr)
+	if _, ok := oack["tsize"]; ok {
+		// the client asked how big the file is
+		if size < 0 {
+			delete(oack, "tsize")
+		} else {
+			oack["tsize"] = strconv.FormatInt(size, 10)
+		}
+	}
+	if len(oack) > 0 {
+		if err := dep.sendOACK(ctx, conn, oack, settings, addr); err != nil {
+			log.Printf("Option negotiation failed: %s", err.Error())
+			return err
+		}
+	}
+	if err := dep.sendData(ctx, conn, data, settings, addr); err != nil {
+		log.Printf("Failed to send %s: %s", p.Filename, err.Error())
+		return err
+	}
+	return nil
 }
 
-func handleWrite(conn net.PacketConn, p PacketRequest, addr net.Addr, dep UtilDependencies) {
+func handleWrite(ctx context.Context, conn net.PacketConn, p PacketRequest, addr net.Addr, config *ServerConfig, dep UtilDependencies) error {
 	log.Printf("Processing write request from %s for file %s", addr.String(), p.Filename)
 	OpLogger.Printf("Received write request: %+v", p)
-	timeout := 10 * time.Second
-	payload := dep.receiveData(conn, timeout, addr)
-	if payload != nil {
-		store.setData(p.Filename, payload)
+	config.limitWindowSize(p.Options)
+	if tsize, ok := p.Options["tsize"]; ok && config.MaxFileSize > 0 {
+		// negotiateTransferSize has already checked that this parses
+		if size, _ := strconv.ParseInt(tsize, 10, 64); size > config.MaxFileSize {
+			message := fmt.Sprintf("File %s is larger than %d bytes", p.Filename, config.MaxFileSize)
+			dep.sendError(conn, 3, message, addr)
+			return errors.New(message)
+		}
+	}
+	handler := config.writeHandler()
+	if handler == nil {
+		dep.sendError(conn, 2, "Writing is not allowed", addr)
+		return ErrAccessViolation
+	}
+	file, err := handler.ServeWrite(ctx, newRequest(p, addr))
+	if err != nil {
+		code, message := storeError(err)
+		dep.sendError(conn, code, message, addr)
+		return err
+	}
+	var data io.Writer = file
+	var netascii *NetasciiWriter
+	if isNetascii(p) && !config.NetasciiCanonical {
+		netascii = NewNetasciiWriter(file)
+		data = netascii
+	}
+	settings := negotiatedSettings(p.Options)
+	settings.retries = config.retries()
+	settings.rto.limit(config.MinTimeout, config.MaxTimeout)
+	// an OACK takes the place of the ack for block 0
+	var start Packet = &PacketAck{BlockNum: 0}
+	if len(p.Options) > 0 {
+		start = &PacketOACK{Options: p.Options}
+	}
+	err = dep.receiveData(ctx, conn, start, data, settings, addr)
+	if err == nil && netascii != nil {
+		err = netascii.Close()
+	}
+	if err != nil {
+		log.Printf("Failed to receive %s: %s", p.Filename, err.Error())
+		file.Abort()
+		return err
+	}
+	if err = file.Commit(); err != nil {
+		log.Printf("Failed to store %s: %s", p.Filename, err.Error())
+		return err
 	}
+	return nil
 }
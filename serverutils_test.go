@@ -2,7 +2,11 @@ package tftp
 
 import (
 	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
 	"net"
+	"strconv"
 	"testing"
 	"time"
 )
@@ -14,12 +18,20 @@ func setupTestInjections(conn net.PacketConn) (testUtils UtilDependencies, testS
 		callCounter[callName] = append(callCounter[callName], params)
 	}
 	testUtils = UtilDependencies{
-		sendData: func(conn net.PacketConn, data [][]byte, timeout time.Duration, dest net.Addr) {
-			countCall("sendData", map[string]interface{}{"conn": conn, "data": data, "timeout": timeout, "dest": dest})
+		sendOACK: func(ctx context.Context, conn net.PacketConn, options map[string]string, s transferSettings, dest net.Addr) error {
+			countCall("sendOACK", map[string]interface{}{"conn": conn, "options": options, "timeout": s.rto.timeout(), "dest": dest})
+			return nil
 		},
-		receiveData: func(conn net.PacketConn, timeout time.Duration, dest net.Addr) [][]byte {
-			countCall("receiveData", map[string]interface{}{"conn": conn, "timeout": timeout, "dest": dest})
-			return make([][]byte, 1)
+		sendData: func(ctx context.Context, conn net.PacketConn, r io.Reader, s transferSettings, dest net.Addr) error {
+			// read everything now, as the reader is closed once handleRead returns
+			data, err := ioutil.ReadAll(r)
+			countCall("sendData", map[string]interface{}{"conn": conn, "data": data, "blockSize": s.blockSize, "windowSize": s.windowSize, "timeout": s.rto.timeout(), "retries": s.retries, "dest": dest})
+			return err
+		},
+		receiveData: func(ctx context.Context, conn net.PacketConn, start Packet, w io.Writer, s transferSettings, dest net.Addr) error {
+			countCall("receiveData", map[string]interface{}{"conn": conn, "start": start, "blockSize": s.blockSize, "windowSize": s.windowSize, "timeout": s.rto.timeout(), "retries": s.retries, "dest": dest})
+			_, err := w.Write(testPayload)
+			return err
 		},
 		sendError: func(conn net.PacketConn, code uint16, message string, dest net.Addr) {
 			countCall("sendError", map[string]interface{}{"conn": conn, "code": code, "message": message, "dest": dest})
@@ -34,16 +46,25 @@ func setupTestInjections(conn net.PacketConn) (testUtils UtilDependencies, testS
 			// this will be counted in testUtils
 			testUtils.sendError(conn, code, message, dest)
 		},
-		handleRead: func(conn net.PacketConn, p PacketRequest, addr net.Addr) {
+		handleRead: func(ctx context.Context, conn net.PacketConn, p PacketRequest, addr net.Addr) error {
 			countCall("handleRead", map[string]interface{}{"conn": conn, "p": p, "addr": addr})
+			return nil
 		},
-		handleWrite: func(conn net.PacketConn, p PacketRequest, addr net.Addr) {
+		handleWrite: func(ctx context.Context, conn net.PacketConn, p PacketRequest, addr net.Addr) error {
 			countCall("handleWrite", map[string]interface{}{"conn": conn, "p": p, "addr": addr})
+			return nil
 		},
 	}
 	return
 }
 
+// testPayload is the data written by the receiveData test injection
+var testPayload = []byte{42}
+
+func newTestConfig() *ServerConfig {
+	return &ServerConfig{Store: NewMapDataStore()}
+}
+
 func TestHandleReadReq(t *testing.T) {
 	testPacketConn := NewPacketConn()
 	_, testServerUtils, callCounter := setupTestInjections(&testPacketConn.Server)
@@ -51,7 +72,7 @@ func TestHandleReadReq(t *testing.T) {
 	fname := "foo.txt"
 	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: fname}
 
-	handleReqDep(p.Serialize(), net.UDPAddr{}, testServerUtils)
+	handleReqDep(context.Background(), p.Serialize(), net.UDPAddr{}, testServerUtils)
 
 	checkErrors(callCounter, t)
 
@@ -81,7 +102,7 @@ func TestHandleWriteReq(t *testing.T) {
 	fname := "foo.txt"
 	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: fname}
 
-	handleReqDep(p.Serialize(), net.UDPAddr{}, testServerUtils)
+	handleReqDep(context.Background(), p.Serialize(), net.UDPAddr{}, testServerUtils)
 
 	checkErrors(callCounter, t)
 
@@ -99,9 +120,10 @@ func TestHandleWriteReq(t *testing.T) {
 func TestHandleWrite(t *testing.T) {
 	testPacketConn := NewPacketConn()
 	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
 
 	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "fname"}
-	handleWrite(&testPacketConn.Server, p, &net.UDPAddr{}, testUtils)
+	handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
 
 	checkErrors(callCounter, t)
 
@@ -109,41 +131,260 @@ func TestHandleWrite(t *testing.T) {
 		t.Error("handleWrite failed to call receiveData")
 	}
 
-	inputData := testUtils.receiveData(&testPacketConn.Server, time.Second, &net.UDPAddr{})
-
-	for i, v := range store.getData("fname") {
-		if !bytes.Equal(v, inputData[i]) {
-			t.Error("input data does not match stored data.")
-		}
+	if !bytes.Equal(getTestData(t, config.Store, "fname"), testPayload) {
+		t.Error("input data does not match stored data.")
 	}
 }
 
 func TestHandleRead(t *testing.T) {
 	testPacketConn := NewPacketConn()
 	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
 
 	fname := "readfile"
 	payload := []byte{42}
-	payload2d := [][]byte{payload}
 
-	store.setData(fname, payload2d)
+	setTestData(t, config.Store, fname, payload)
 
 	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: fname}
-	handleRead(&testPacketConn.Server, p, &net.UDPAddr{}, testUtils)
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
 
 	checkErrors(callCounter, t)
 
-	if len(callCounter["sendData"]) < 1 {
-		t.Error("handleRead failed to call sendData")
+	calls := callCounter["sendData"]
+	if len(calls) < 1 {
+		t.Fatal("handleRead failed to call sendData")
+	}
+
+	if !bytes.Equal(calls[0]["data"].([]byte), payload) {
+		t.Error("sent data does not match stored data.")
+	}
+}
+
+func TestHandleReqUnknownOption(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	_, testServerUtils, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: "foo.txt", Options: map[string]string{"fnord": "1"}}
+	handleReqDep(context.Background(), p.Serialize(), net.UDPAddr{}, testServerUtils)
+
+	checkErrors(callCounter, t)
+
+	calls := callCounter["handleRead"]
+	if len(calls) < 1 {
+		t.Fatal("Read Request did not call handleRead()")
+	}
+	if options := calls[0]["p"].(PacketRequest).Options; len(options) != 0 {
+		t.Errorf("Unknown option was not ignored: %v", options)
+	}
+}
+
+func TestNegotiateOptions(t *testing.T) {
+	optionNegotiators["test"] = func(value string) (string, bool) {
+		return "accepted", value == "ok"
+	}
+	defer delete(optionNegotiators, "test")
+
+	accepted := negotiateOptions(map[string]string{"test": "ok", "fnord": "1"})
+	if len(accepted) != 1 || accepted["test"] != "accepted" {
+		t.Errorf("Expected only the test option to be accepted, got %v", accepted)
+	}
+	if accepted = negotiateOptions(map[string]string{"test": "bad"}); len(accepted) != 0 {
+		t.Errorf("Expected unacceptable option to be ignored, got %v", accepted)
+	}
+}
+
+func TestHandleReadWithOptions(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+
+	fname := "optionsfile"
+	setTestData(t, config.Store, fname, []byte{42})
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: fname, Options: map[string]string{"blksize": "1024"}}
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	checkErrors(callCounter, t)
+
+	if len(callCounter["sendOACK"]) < 1 {
+		t.Error("handleRead did not acknowledge options")
+	}
+	calls := callCounter["sendData"]
+	if len(calls) < 1 {
+		t.Fatal("handleRead failed to call sendData")
+	}
+	if calls[0]["blockSize"] != 1024 {
+		t.Errorf("Expected negotiated block size 1024, got %v", calls[0]["blockSize"])
+	}
+}
+
+func TestHandleReadMaxWindowSize(t *testing.T) {
+	for _, max := range []int{0, 8} {
+		testPacketConn := NewPacketConn()
+		testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+		config := newTestConfig()
+		config.MaxWindowSize = max
+		expected := max
+		if expected == 0 {
+			expected = DefaultMaxWindowSize
+		}
+
+		fname := "windowfile"
+		setTestData(t, config.Store, fname, []byte{42})
+		p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: fname, Options: map[string]string{"windowsize": "65535"}}
+		handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+		checkErrors(callCounter, t)
+		oacks := callCounter["sendOACK"]
+		if len(oacks) < 1 {
+			t.Fatal("handleRead did not acknowledge options")
+		}
+		if offered := oacks[0]["options"].(map[string]string)["windowsize"]; offered != strconv.Itoa(expected) {
+			t.Errorf("Expected windowsize %d to be offered, got %s", expected, offered)
+		}
+		calls := callCounter["sendData"]
+		if len(calls) < 1 {
+			t.Fatal("handleRead failed to call sendData")
+		}
+		if calls[0]["windowSize"] != expected {
+			t.Errorf("Expected negotiated window size %d, got %v", expected, calls[0]["windowSize"])
+		}
 	}
+}
 
-	for i, v := range store.getData(fname) {
-		if !bytes.Equal(v, payload2d[i]) {
-			t.Error("input data does not match stored data.")
+func TestNegotiateBlockSize(t *testing.T) {
+	tests := []struct {
+		requested string
+		accepted  string
+		ok        bool
+	}{
+		{"512", "512", true},
+		{"1428", "1428", true},
+		{"8", "8", true},
+		{"7", "", false},
+		{"fnord", "", false},
+		// anything larger than a packet we can read is counter-offered
+		{"65464", strconv.Itoa(MaxPacketSize - 4), true},
+		{"100000", strconv.Itoa(MaxPacketSize - 4), true},
+	}
+	for _, test := range tests {
+		accepted, ok := negotiateBlockSize(test.requested)
+		if accepted != test.accepted || ok != test.ok {
+			t.Errorf("blksize %s: expected (%q, %t); got (%q, %t)", test.requested, test.accepted, test.ok, accepted, ok)
 		}
 	}
 }
 
+func TestHandleWriteWithOptions(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "fname", Options: map[string]string{"windowsize": "4"}}
+	handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	calls := callCounter["receiveData"]
+	if len(calls) < 1 {
+		t.Fatal("handleWrite failed to call receiveData")
+	}
+	if _, ok := calls[0]["start"].(*PacketOACK); !ok {
+		t.Errorf("Expected write to start with an OACK, got %+v", calls[0]["start"])
+	}
+	if calls[0]["windowSize"] != 4 {
+		t.Errorf("Expected negotiated window size 4, got %v", calls[0]["windowSize"])
+	}
+}
+
+func TestNegotiateTimeout(t *testing.T) {
+	tests := []struct {
+		requested string
+		ok        bool
+	}{
+		{"1", true},
+		{"255", true},
+		{"0", false},
+		{"256", false},
+		{"fnord", false},
+	}
+	for _, test := range tests {
+		accepted, ok := negotiateTimeout(test.requested)
+		if ok != test.ok || (ok && accepted != test.requested) {
+			t.Errorf("timeout %s: expected ok %t; got (%q, %t)", test.requested, test.ok, accepted, ok)
+		}
+	}
+}
+
+func TestHandleReadTransferSize(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+
+	fname := "tsizefile"
+	setTestData(t, config.Store, fname, bytes.Join(generateTestData(3, 10), nil))
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: fname, Options: map[string]string{"tsize": "0", "timeout": "3"}}
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	checkErrors(callCounter, t)
+
+	calls := callCounter["sendOACK"]
+	if len(calls) < 1 {
+		t.Fatal("handleRead did not acknowledge options")
+	}
+	if tsize := calls[0]["options"].(map[string]string)["tsize"]; tsize != "1034" {
+		t.Errorf("Expected tsize 1034, got %s", tsize)
+	}
+	if timeout := calls[0]["timeout"]; timeout != 3*time.Second {
+		t.Errorf("Expected negotiated timeout of 3s, got %v", timeout)
+	}
+}
+
+func TestHandleReadLeavesRequestOptions(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+	var kept *Request
+	config.ReadHandler = ReadHandlerFunc(func(ctx context.Context, r *Request) (io.ReadCloser, int64, error) {
+		kept = r
+		return ioutil.NopCloser(bytes.NewReader([]byte("foo"))), 3, nil
+	})
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: "foo", Options: map[string]string{"tsize": "0"}}
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	checkErrors(callCounter, t)
+	calls := callCounter["sendOACK"]
+	if len(calls) < 1 {
+		t.Fatal("handleRead did not acknowledge options")
+	}
+	if tsize := calls[0]["options"].(map[string]string)["tsize"]; tsize != "3" {
+		t.Errorf("Expected tsize 3, got %s", tsize)
+	}
+	if tsize := kept.Options["tsize"]; tsize != "0" {
+		t.Errorf("Expected the handler's request to be left alone, but its tsize became %s", tsize)
+	}
+}
+
+func TestHandleWriteTooLarge(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+
+	config.MaxFileSize = 1024
+
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "bigfile", Options: map[string]string{"tsize": "1025"}}
+	handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	calls := callCounter["sendError"]
+	if len(calls) < 1 || calls[0]["code"] != uint16(3) {
+		t.Errorf("Expected error 3 for oversized write, got %v", calls)
+	}
+	if len(callCounter["receiveData"]) > 0 {
+		t.Error("handleWrite accepted data for an oversized write")
+	}
+}
+
 func TestHandleReqBadMode(t *testing.T) {
 	testPacketConn := NewPacketConn()
 	_, testServerUtils, callCounter := setupTestInjections(&testPacketConn.Server)
@@ -152,7 +393,7 @@ func TestHandleReqBadMode(t *testing.T) {
 	p := PacketRequest{Op: OpWRQ, Mode: "ascii", Filename: fname}
 
 	// We expect an error packet in response, as ascii mode is not supported
-	handleReqDep(p.Serialize(), net.UDPAddr{}, testServerUtils)
+	handleReqDep(context.Background(), p.Serialize(), net.UDPAddr{}, testServerUtils)
 
 	_, ok := callCounter["sendError"]
 	if !ok {
@@ -160,21 +401,101 @@ func TestHandleReqBadMode(t *testing.T) {
 	}
 }
 
+func TestHandleReqNetascii(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	_, testServerUtils, callCounter := setupTestInjections(&testPacketConn.Server)
+
+	p := PacketRequest{Op: OpRRQ, Mode: "NetASCII", Filename: "foo.txt"}
+	handleReqDep(context.Background(), p.Serialize(), net.UDPAddr{}, testServerUtils)
+
+	checkErrors(callCounter, t)
+
+	if len(callCounter["handleRead"]) < 1 {
+		t.Fatal("Netascii Read Request did not call handleRead()")
+	}
+}
+
+func TestHandleReadNetascii(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+
+	fname := "netascii.txt"
+	setTestData(t, config.Store, fname, []byte("foo\nbar\n"))
+
+	p := PacketRequest{Op: OpRRQ, Mode: "netascii", Filename: fname}
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	checkErrors(callCounter, t)
+
+	calls := callCounter["sendData"]
+	if len(calls) < 1 {
+		t.Fatal("handleRead failed to call sendData")
+	}
+	sent := calls[0]["data"].([]byte)
+	if string(sent) != "foo\r\nbar\r\n" {
+		t.Errorf("Expected netascii data to be sent, got %q", sent)
+	}
+}
+
+func TestHandleReadNetasciiTransferSize(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+
+	fname := "netascii.txt"
+	setTestData(t, config.Store, fname, []byte("foo\nbar\n"))
+
+	// the size after conversion isn't known, so tsize can't be acknowledged
+	p := PacketRequest{Op: OpRRQ, Mode: "netascii", Filename: fname, Options: map[string]string{"tsize": "0", "blksize": "1024"}}
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	calls := callCounter["sendOACK"]
+	if len(calls) < 1 {
+		t.Fatal("handleRead did not acknowledge options")
+	}
+	if _, ok := calls[0]["options"].(map[string]string)["tsize"]; ok {
+		t.Error("tsize was acknowledged for a netascii read")
+	}
+}
+
+func TestHandleWriteNetascii(t *testing.T) {
+	for _, canonical := range []bool{false, true} {
+		testPacketConn := NewPacketConn()
+		testUtils, _, _ := setupTestInjections(&testPacketConn.Server)
+		config := newTestConfig()
+		testUtils.receiveData = func(ctx context.Context, conn net.PacketConn, start Packet, w io.Writer, s transferSettings, dest net.Addr) error {
+			_, err := w.Write([]byte("foo\r\nbar\r\x00"))
+			return err
+		}
+
+		config.NetasciiCanonical = canonical
+		p := PacketRequest{Op: OpWRQ, Mode: "netascii", Filename: "netascii.txt"}
+		handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+		expected := "foo\nbar\r"
+		if canonical {
+			expected = "foo\r\nbar\r\x00"
+		}
+		if stored := getTestData(t, config.Store, p.Filename); string(stored) != expected {
+			t.Errorf("Canonical %t: expected %q to be stored, got %q", canonical, expected, stored)
+		}
+	}
+}
+
 func TestHandleReadMissingFile(t *testing.T) {
 
 	testPacketConn := NewPacketConn()
 	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
 
 	fname := "readfile"
 
-	// reset the store so tests don't bleed state here
-	// TODO: remove global state
-	store = MapDataStore{mapStore: make(map[string][][]byte)}
 	// this is just like testHandleRead, but we don't set the file first
-	// store.setData(fname, payload2d)
+	// setTestData(t, config.Store, fname, payload)
 
 	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: fname}
-	handleRead(&testPacketConn.Server, p, &net.UDPAddr{}, testUtils)
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
 
 	_, ok := callCounter["sendError"]
 	if !ok {
@@ -183,3 +504,76 @@ func TestHandleReadMissingFile(t *testing.T) {
 }
 
 // noSuchKey
+
+func TestHandleReadSeparateStores(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config, other := newTestConfig(), newTestConfig()
+
+	fname := "readfile"
+	setTestData(t, other.Store, fname, []byte{42})
+
+	// the file is only in the other server's store
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: fname}
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	calls := callCounter["sendError"]
+	if len(calls) < 1 || calls[0]["code"] != uint16(1) {
+		t.Errorf("Expected file not found from a separate store, got %v", calls)
+	}
+}
+
+func TestHandleReadRetries(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, callCounter := setupTestInjections(&testPacketConn.Server)
+	config := newTestConfig()
+	config.Retries = 3
+
+	setTestData(t, config.Store, "readfile", []byte{42})
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: "readfile"}
+	handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+
+	calls := callCounter["sendData"]
+	if len(calls) < 1 {
+		t.Fatal("handleRead failed to call sendData")
+	}
+	if calls[0]["retries"] != 3 {
+		t.Errorf("Expected 3 retries, got %v", calls[0]["retries"])
+	}
+}
+
+func TestHandleReadTimeout(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, _ := setupTestInjections(&testPacketConn.Server)
+	testUtils.sendData = func(ctx context.Context, conn net.PacketConn, r io.Reader, s transferSettings, dest net.Addr) error {
+		return &TimeoutError{Retries: s.retries}
+	}
+	config := newTestConfig()
+	setTestData(t, config.Store, "readfile", []byte{42})
+
+	p := PacketRequest{Op: OpRRQ, Mode: "octet", Filename: "readfile"}
+	err := handleRead(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+	if timeout, ok := err.(*TimeoutError); !ok || timeout.Retries != DefaultRetries {
+		t.Errorf("Expected a timeout after %d retries, got %v", DefaultRetries, err)
+	}
+}
+
+func TestHandleWriteTimeout(t *testing.T) {
+	testPacketConn := NewPacketConn()
+	testUtils, _, _ := setupTestInjections(&testPacketConn.Server)
+	testUtils.receiveData = func(ctx context.Context, conn net.PacketConn, start Packet, w io.Writer, s transferSettings, dest net.Addr) error {
+		w.Write(testPayload)
+		return &TimeoutError{Retries: s.retries}
+	}
+	config := newTestConfig()
+
+	p := PacketRequest{Op: OpWRQ, Mode: "octet", Filename: "fname"}
+	err := handleWrite(context.Background(), &testPacketConn.Server, p, &net.UDPAddr{}, config, testUtils)
+	if _, ok := err.(*TimeoutError); !ok {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+	if _, _, err = config.Store.Open(context.Background(), "fname"); err != ErrNotFound {
+		t.Error("handleWrite stored a file from an abandoned transfer")
+	}
+}
@@ -0,0 +1,147 @@
+package tftp
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// sharedQueue is how many datagrams a transfer in single port mode may
+// fall behind by before more are dropped, as a socket's buffer would.
+const sharedQueue = 64
+
+// sharedConn is the PacketConn of a transfer in single port mode.  It
+// reads the datagrams the server routes to it from its client, and
+// writes through the listening socket, so every packet the client sees
+// comes from the port it sent its request to.
+type sharedConn struct {
+	listener net.PacketConn
+	remote   net.Addr
+	packets  chan []byte
+	closed   chan struct{}
+	// onClose is called once, when the transfer is over
+	onClose   func()
+	closeOnce sync.Once
+
+	mu       sync.Mutex
+	deadline time.Time
+	// wake is closed, and replaced, whenever the deadline changes
+	wake chan struct{}
+}
+
+func newSharedConn(listener net.PacketConn, remote net.Addr, onClose func()) *sharedConn {
+	return &sharedConn{
+		listener: listener,
+		remote:   remote,
+		packets:  make(chan []byte, sharedQueue),
+		closed:   make(chan struct{}),
+		onClose:  onClose,
+		wake:     make(chan struct{}),
+	}
+}
+
+// deliver queues b to be read, or drops it if the queue is full
+// or the transfer is over.
+func (c *sharedConn) deliver(b []byte) {
+	select {
+	case <-c.closed:
+	case c.packets <- b:
+	default:
+	}
+}
+
+// ReadFrom reads the next datagram from the client.
+func (c *sharedConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		select {
+		case <-c.closed:
+			return 0, nil, errTransferClosed
+		default:
+		}
+		c.mu.Lock()
+		deadline, wake := c.deadline, c.wake
+		c.mu.Unlock()
+
+		var timer *time.Timer
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			wait := time.Until(deadline)
+			if wait <= 0 {
+				return 0, nil, sharedTimeout{}
+			}
+			timer = time.NewTimer(wait)
+			expired = timer.C
+		}
+		select {
+		case b := <-c.packets:
+			stopTimer(timer)
+			return copy(p, b), c.remote, nil
+		case <-c.closed:
+			stopTimer(timer)
+			return 0, nil, errTransferClosed
+		case <-expired:
+			return 0, nil, sharedTimeout{}
+		case <-wake:
+			// look at the new deadline
+			stopTimer(timer)
+		}
+	}
+}
+
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// WriteTo writes p to addr through the listening socket.
+func (c *sharedConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	select {
+	case <-c.closed:
+		return 0, errTransferClosed
+	default:
+	}
+	return c.listener.WriteTo(p, addr)
+}
+
+// Close ends the transfer, leaving the listening socket open.
+func (c *sharedConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.onClose()
+	})
+	return nil
+}
+
+func (c *sharedConn) LocalAddr() net.Addr {
+	return c.listener.LocalAddr()
+}
+
+func (c *sharedConn) SetDeadline(t time.Time) error {
+	return c.SetReadDeadline(t)
+}
+
+func (c *sharedConn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.deadline = t
+	close(c.wake)
+	c.wake = make(chan struct{})
+	return nil
+}
+
+// SetWriteDeadline does nothing, as writes to a UDP socket don't block.
+func (c *sharedConn) SetWriteDeadline(t time.Time) error {
+	return nil
+}
+
+// errTransferClosed is returned by a sharedConn once it is closed.
+var errTransferClosed = errors.New("use of closed transfer")
+
+// sharedTimeout is the error of a read whose deadline has passed.
+type sharedTimeout struct{}
+
+func (sharedTimeout) Error() string   { return "i/o timeout" }
+func (sharedTimeout) Timeout() bool   { return true }
+func (sharedTimeout) Temporary() bool { return true }
@@ -0,0 +1,182 @@
+package tftp
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSharedConn(t *testing.T) {
+	conn := NewPacketConn()
+	remote := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	closed := 0
+	shared := newSharedConn(&conn.Server, remote, func() { closed++ })
+
+	shared.deliver([]byte{1, 2, 3})
+	buf := make([]byte, 16)
+	n, addr, err := shared.ReadFrom(buf)
+	if err != nil || !bytes.Equal(buf[:n], []byte{1, 2, 3}) || addr != remote {
+		t.Errorf("Expected the delivered packet from %s, got %v from %v, %v", remote, buf[:n], addr, err)
+	}
+
+	shared.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, _, err = shared.ReadFrom(buf); !isTimeout(err) {
+		t.Errorf("Expected a timeout, got %v", err)
+	}
+
+	// a deadline set while reading wakes the reader
+	shared.SetReadDeadline(time.Time{})
+	read := make(chan error)
+	go func() {
+		_, _, err := shared.ReadFrom(buf)
+		read <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	shared.SetReadDeadline(time.Unix(1, 0))
+	if err = <-read; !isTimeout(err) {
+		t.Errorf("Expected the read to be interrupted, got %v", err)
+	}
+
+	// writes go through the listener
+	go shared.WriteTo([]byte{4, 5}, remote)
+	if n, _, err = conn.Client.ReadFrom(buf); err != nil || !bytes.Equal(buf[:n], []byte{4, 5}) {
+		t.Errorf("Expected the write on the listener, got %v, %v", buf[:n], err)
+	}
+
+	shared.Close()
+	shared.Close()
+	if closed != 1 {
+		t.Errorf("Expected onClose to be called once, got %d", closed)
+	}
+	shared.deliver([]byte{6})
+	if _, _, err = shared.ReadFrom(buf); err != errTransferClosed {
+		t.Errorf("Expected errTransferClosed, got %v", err)
+	}
+}
+
+func TestServeSinglePortRouting(t *testing.T) {
+	conn := NewPacketConn()
+	received := make(chan []byte)
+	s, started := newTestServer(nil)
+	s.SinglePort = true
+	s.handle = func(ctx context.Context, buf []byte, addr net.UDPAddr, config *ServerConfig, open func() (net.PacketConn, error)) error {
+		started <- PacketRequest{}
+		transfer, _ := open()
+		defer transfer.Close()
+		b := make([]byte, 16)
+		n, _, err := transfer.ReadFrom(b)
+		received <- b[:n]
+		return err
+	}
+	served := make(chan error)
+	go func() {
+		served <- s.Serve(&conn.Server)
+	}()
+
+	request := PacketRequest{Op: OpRRQ, Filename: "foo", Mode: "octet"}
+	conn.Client.WriteTo(request.Serialize(), nil)
+	<-started
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	// the listener stays open, carrying the transfer
+	time.Sleep(10 * time.Millisecond)
+	ack := PacketAck{BlockNum: 1}
+	conn.Client.WriteTo(ack.Serialize(), nil)
+	if b := <-received; !bytes.Equal(b, ack.Serialize()) {
+		t.Errorf("Expected the ack to reach the transfer, got %v", b)
+	}
+	if err := <-shutdown; err != nil {
+		t.Errorf("Shutdown failed: %v", err)
+	}
+	if err := <-served; err != ErrServerClosed {
+		t.Errorf("Expected Serve to return ErrServerClosed, got %v", err)
+	}
+}
+
+func TestServeSinglePort(t *testing.T) {
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Skipf("Can't listen on loopback: %v", err)
+	}
+	s := &Server{ServerConfig: *newTestConfig(), SinglePort: true}
+	go s.Serve(listener)
+	defer s.Shutdown(context.Background())
+	addr := listener.LocalAddr().String()
+
+	// every packet comes from the port the request was sent to
+	client := &Client{
+		ListenPacket: func() (net.PacketConn, error) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			return &fromChecker{PacketConn: conn, t: t, from: addr}, err
+		},
+		TransferSize: true,
+		WindowSize:   4,
+	}
+	value := bytes.Join(generateTestData(20, 10), nil)
+	if err = client.Put(context.Background(), addr, "foo", bytes.NewReader(value)); err != nil {
+		t.Fatal(err)
+	}
+
+	// concurrent transfers are kept apart
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var result bytes.Buffer
+			if err := client.Get(context.Background(), addr, "foo", &result); err != nil {
+				t.Error(err)
+			} else if !bytes.Equal(result.Bytes(), value) {
+				t.Error("Data corruption detected.")
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// fromChecker fails the test if a packet comes from anywhere but from
+type fromChecker struct {
+	net.PacketConn
+	t    *testing.T
+	from string
+}
+
+func (c *fromChecker) ReadFrom(p []byte) (int, net.Addr, error) {
+	n, addr, err := c.PacketConn.ReadFrom(p)
+	if err == nil && addr.String() != c.from {
+		c.t.Errorf("Expected packets from %s, got one from %s", c.from, addr.String())
+	}
+	return n, addr, err
+}
+
+func TestListenTransferPort(t *testing.T) {
+	probe, err := net.ListenPacket("udp", ":0")
+	if err != nil {
+		t.Skipf("Can't listen: %v", err)
+	}
+	port := probe.LocalAddr().(*net.UDPAddr).Port
+
+	// the only port in the range is taken
+	config := ServerConfig{MinPort: port, MaxPort: port}
+	if conn, err := config.listenTransferPort(nil); err == nil {
+		conn.Close()
+		t.Errorf("Expected no free port in a range of %d alone", port)
+	}
+	probe.Close()
+
+	conn, err := config.listenTransferPort(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, actual, _ := net.SplitHostPort(conn.LocalAddr().String()); actual != strconv.Itoa(port) {
+		t.Errorf("Expected port %d, got %s", port, actual)
+	}
+}
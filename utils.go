@@ -1,150 +1,455 @@
 package tftp
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"log"
 	"net"
 	"os"
+	"strconv"
 	"time"
 )
 
 // functions in this file are designed to be of value to clients
 // as well as to the server, so they are kept separate.
 
-// MaxPacketSize is the number of bytes read off the socket.
-// The largest payload in one data message is 516 bytes, but read more to be sure
+// MaxPacketSize is the number of bytes read off the socket.  A DATA packet
+// carries 4 bytes of header, so it caps the negotiated blksize, at 2044 bytes
+// by default.  Larger block sizes need it raised, as tftpd's
+// -max-packet-size flag does.
 var MaxPacketSize = 2048
 
-// the largest data block in one message is 512 bytes
-const maxPayload int = 512
+// Data blocks are 512 bytes unless the blksize option (RFC 2348)
+// negotiates a size between minBlockSize and maxBlockSize.
+const (
+	defaultBlockSize int = 512
+	minBlockSize     int = 8
+	maxBlockSize     int = 65464
+)
+
+// The timeout option (RFC 2349) negotiates a fixed retransmission timeout,
+// of a number of seconds between minTimeout and maxTimeout.  Without it,
+// the timeout adapts to the network, up to defaultTimeout.
+const (
+	defaultTimeout = 10 * time.Second
+	minTimeout     = 1
+	maxTimeout     = 255
+)
 
-func sendData(conn net.PacketConn, data [][]byte, timeout time.Duration, dest net.Addr) {
-	// by iterating with int (32 bits or greater), we can handle
-	// files up to at least 2^(31+9) bytes (1TB) in size, because
-	// the cast to uint16 for the block number will roll over.
-	for i, block := range data {
-		// alternate sending data and awaiting acks
-		// we will retry sending the data packet if
-		// no ack after timeout
+// largestBlockSize returns the largest block that fits in a packet of
+// MaxPacketSize bytes, after the opcode and block number.
+func largestBlockSize() int {
+	if size := MaxPacketSize - 4; size < maxBlockSize {
+		return size
+	}
+	return maxBlockSize
+}
+
+// Without the windowsize option (RFC 7440), every data block is acked
+// before the next is sent.
+const (
+	defaultWindowSize int = 1
+	minWindowSize     int = 1
+	maxWindowSize     int = 65535
+)
 
-		blockNum := uint16(i + 1)
+// DefaultRetries is how many times a packet is resent before a transfer
+// is abandoned, unless the client or server is configured otherwise.
+const DefaultRetries = 5
 
-		// ignore acks for other blocks, as they could
+// DefaultMaxWindowSize is the largest windowsize a server accepts,
+// unless its ServerConfig says otherwise.
+const DefaultMaxWindowSize = 64
+
+// transferSettings holds the parameters of a single transfer, as
+// negotiated with options or configured by the client or server.
+type transferSettings struct {
+	blockSize  int
+	windowSize int
+	rto        *retransmitTimer
+	// retries is how many times a packet is resent before giving up.
+	// Zero means it is resent forever.
+	retries int
+}
+
+// negotiatedSettings returns the settings acknowledged in options,
+// with the default for each option that was not negotiated.  Each call
+// returns a new retransmitTimer, so it should be called once per transfer.
+func negotiatedSettings(options map[string]string) transferSettings {
+	s := transferSettings{
+		blockSize:  defaultBlockSize,
+		windowSize: defaultWindowSize,
+		rto:        newRetransmitTimer(defaultMinRTO, defaultMaxRTO),
+	}
+	if size, err := strconv.Atoi(options["blksize"]); err == nil {
+		s.blockSize = size
+	}
+	if size, err := strconv.Atoi(options["windowsize"]); err == nil {
+		s.windowSize = size
+	}
+	if seconds, err := strconv.Atoi(options["timeout"]); err == nil {
+		s.rto = fixedTimer(time.Duration(seconds) * time.Second)
+	}
+	return s
+}
+
+// sendData streams the contents of r to dest, in blocks of s.blockSize bytes.
+// Only the current window of blocks is held in memory, so it can be resent.
+func sendData(ctx context.Context, conn net.PacketConn, r io.Reader, s transferSettings, dest net.Addr) error {
+	// blocks holds the data sent since the last ack, starting with
+	// block lastAcked+1.  Block numbers are uint16, so they will roll
+	// over for files larger than 2^16 blocks.
+	var blocks [][]byte
+	var lastAcked uint16
+	eof := false
+	for {
+		// read enough to fill the window
+		for len(blocks) < s.windowSize && !eof {
+			block := make([]byte, s.blockSize)
+			n, err := io.ReadFull(r, block)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				// any block shorter than the block size, even an empty
+				// one, is a signal for EOF
+				eof = true
+			} else if err != nil {
+				writeError(conn, 0, err.Error(), dest)
+				return err
+			}
+			blocks = append(blocks, block[:n])
+		}
+		if len(blocks) == 0 {
+			// everything has been acked
+			return nil
+		}
+
+		// send a window of data packets, and await an ack for any of them.
+		// we will resend the whole window if no ack after timeout
+		window := make([]Packet, len(blocks))
+		for i, block := range blocks {
+			window[i] = &PacketData{BlockNum: lastAcked + uint16(i+1), Data: block}
+		}
+
+		// ignore acks for blocks outside the window, as they could
 		// be duplicates, causing the Sorcerer's Apprentice
 		// Syndrome (https://en.wikipedia.org/wiki/Sorcerer%27s_Apprentice_Syndrome)
 		success := func(p Packet) (result bool) {
 			v, ok := p.(*PacketAck)
-			result = ok && v.BlockNum == blockNum
+			result = ok && v.BlockNum-lastAcked >= 1 && int(v.BlockNum-lastAcked) <= len(window)
 			if result {
 				log.Printf("Received response packet: %+v\n", v)
 			} else {
-				log.Printf("Expected Ack %d, but got %+v\n", blockNum, p)
+				log.Printf("Expected Ack %d to %d, but got %+v\n", lastAcked+1, lastAcked+uint16(len(window)), p)
 			}
 			return
 		}
-		_, err := sendAndWait(conn, &PacketData{BlockNum: blockNum, Data: block[:]},
-			timeout,
-			success,
-			dest)
+		packet, _, err := exchange(ctx, conn, window, true, s.rto, s.retries, success, dest)
 		if err != nil {
-			// TODO: check that this is the right error handling mechanism
 			log.Printf("Failed to send data: %s", err.Error())
-			return
+			return err
 		}
+		// an ack for a block before the end of the window means the
+		// receiver saw a gap, so the next window starts after that block
+		ack, _ := packet.(*PacketAck)
+		blocks = blocks[ack.BlockNum-lastAcked:]
+		lastAcked = ack.BlockNum
 	}
 }
 
-func receiveData(conn net.PacketConn, timeout time.Duration, dest net.Addr) [][]byte {
-	var dp *PacketData
+// sendOACK acknowledges the options of a read request, and waits for
+// the client to confirm them with an ack for block 0.
+func sendOACK(ctx context.Context, conn net.PacketConn, options map[string]string, s transferSettings, dest net.Addr) error {
+	success := func(p Packet) (result bool) {
+		v, ok := p.(*PacketAck)
+		result = ok && v.BlockNum == 0
+		if result {
+			log.Printf("Received response packet: %+v\n", v)
+		} else {
+			log.Printf("Expected Ack 0, but got %+v\n", p)
+		}
+		return
+	}
+	_, _, err := sendAndWait(ctx, conn, &PacketOACK{Options: options}, s.rto, s.retries, success, dest)
+	return err
+}
+
+// receiveData solicits the next data block by sending start, which is
+// either an OACK or an ack for the last block already received, usually
+// block 0.  After that, it acks the last block of each window received,
+// or the last block received in order if it sees a gap, as described in
+// RFC 7440.  Data is written to w as it arrives.
+func receiveData(ctx context.Context, conn net.PacketConn, start Packet, w io.Writer, s transferSettings, dest net.Addr) error {
+	toSend := start
+	sendNow := true
 	ack := PacketAck{BlockNum: 0}
-	var payload = make([][]byte, 0)
-	// any payload shorter than 512 bytes is a signal for EOF
-	for dp == nil || len(dp.Data) == maxPayload {
-		success := func(p Packet) (result bool) {
-			dataPacket, ok := p.(*PacketData)
-			blockNum := ack.BlockNum + 1
-			result = ok && dataPacket.BlockNum == blockNum
-			if result {
-				log.Printf("Received response packet: %+v\n", dataPacket)
-			} else {
-				log.Printf("Expected Data Block %d, but got %+v\n", blockNum, p)
-			}
-			return
+	if startAck, ok := start.(*PacketAck); ok {
+		ack.BlockNum = startAck.BlockNum
+	}
+	inWindow := 0
+	gapAcked := false
+	isData := func(p Packet) (result bool) {
+		_, result = p.(*PacketData)
+		if result {
+			log.Printf("Received response packet: %+v\n", p)
+		} else {
+			log.Printf("Expected Data Block %d, but got %+v\n", ack.BlockNum+1, p)
 		}
-		packet, err := sendAndWait(conn, &ack, timeout, success, dest)
+		return
+	}
+	for {
+		packet, _, err := exchange(ctx, conn, []Packet{toSend}, sendNow, s.rto, s.retries, isData, dest)
 		if err != nil {
 			log.Printf("Failed to receive data: %s", err.Error())
-			return nil
+			return err
 		}
 		// cast will always succeed, because we've already cast in success criteria
-		dp, _ = packet.(*PacketData)
+		dp, _ := packet.(*PacketData)
 
-		// put the bytes somewhere
-		payload = append(payload, dp.Data)
-		ack.BlockNum++
+		ahead := dp.BlockNum - ack.BlockNum
+		switch {
+		case ahead == 1:
+			// put the bytes somewhere
+			if _, err = w.Write(dp.Data); err != nil {
+				writeError(conn, 3, err.Error(), dest)
+				return err
+			}
+			ack.BlockNum++
+			toSend = &ack
+			// any payload shorter than the block size is a signal for EOF
+			if len(dp.Data) < s.blockSize {
+				conn.WriteTo(ack.Serialize(), dest)
+				return nil
+			}
+			inWindow++
+			sendNow = inWindow == s.windowSize
+			if sendNow {
+				inWindow = 0
+			}
+			gapAcked = false
+		case ahead > 1 && int(ahead) <= s.windowSize && !gapAcked:
+			// a block went missing, so ask for everything after
+			// the last one we have
+			log.Printf("Expected Data Block %d, but got %d\n", ack.BlockNum+1, dp.BlockNum)
+			toSend = &ack
+			sendNow = true
+			inWindow = 0
+			gapAcked = true
+		default:
+			// a duplicate, or more of a window we have already
+			// asked to be resent
+			sendNow = false
+		}
 	}
-	conn.WriteTo(ack.Serialize(), dest)
-	return payload
+}
+
+// TimeoutError is returned when the peer stops responding, and a packet
+// has been resent as many times as allowed.
+type TimeoutError struct {
+	Retries int
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("no response after %d retries", e.Retries)
+}
+
+// Timeout reports that the error is a timeout, as net.Error does.
+func (e *TimeoutError) Timeout() bool {
+	return true
+}
+
+// Temporary reports that the transfer cannot be resumed, as net.Error does.
+func (e *TimeoutError) Temporary() bool {
+	return false
 }
 
 // SuccessCriteria helps us know when we have received the expected response
 // when sending a packet and waiting for a response
 type SuccessCriteria func(Packet) bool
 
-func sendAndWait(conn net.PacketConn, toSend Packet, timeout time.Duration, success SuccessCriteria, dest net.Addr) (responsePacket Packet, err error) {
-	cerror := make(chan error)
-	cresult := make(chan Packet)
-	for {
-		log.Printf("Sending response: %+v\n", toSend)
-		_, err = conn.WriteTo(toSend.Serialize(), dest)
-		if err != nil {
-			// if we fail to write, we should exit, as we can't send an error packet
-			return
-		}
+// sendAndWait sends toSend, and waits for a response meeting the success
+// criteria, resending it up to retries times.  Zero retries means forever.
+// The time to wait before resending is taken from rto, which learns from
+// the round trip time of the exchange.  If ctx is done first, the peer is
+// sent an ERROR packet, and ctx.Err() is returned.  The response is
+// returned with the address it came from, as exchange does.
+func sendAndWait(ctx context.Context, conn net.PacketConn, toSend Packet, rto *retransmitTimer, retries int, success SuccessCriteria, dest net.Addr) (responsePacket Packet, from net.Addr, err error) {
+	return exchange(ctx, conn, []Packet{toSend}, true, rto, retries, success, dest)
+}
 
-		go func() {
-			var received Packet
-			// until we have success, do this
-			for received == nil || !success(received) {
-				bytes := make([]byte, MaxPacketSize)
-				n, _, error := conn.ReadFrom(bytes)
-				if error != nil {
-					sendError(conn, 0, error.Error(), dest)
-					cerror <- error
-					return
-				}
-				// trim any trailing bytes
-				bytes = bytes[:n]
-				received, error = ParsePacket(bytes)
-				if error != nil {
-					log.Printf("Received garbage data, still waiting for packet.")
-					sendError(conn, 0, error.Error(), dest)
-					cerror <- error
+// exchange sends each packet in toSend, and waits for a response meeting
+// the success criteria, sending them all again whenever the timeout given
+// by rto elapses.  The timeout doubles with each resend, and the round
+// trip time is sampled if the first send is answered.
+// If sendNow is false, nothing is sent until the first timeout.  If ctx
+// is done, the exchange ends with an ERROR packet to the peer, and returns
+// ctx.Err(), as soon as any read is interrupted by watchContext.  After
+// retries resends without a response it gives up, sending the peer an
+// ERROR packet and returning a *TimeoutError, unless retries is zero.
+// An ERROR packet from the peer ends the exchange, and is returned as err.
+// Packets from any other address are answered with error 5, as RFC 1350
+// requires, and otherwise ignored.  The exception is a request, which
+// the server answers from a new port, so the first response to it is
+// accepted from anywhere.  The address the response came from is
+// returned along with it, as a client needs it to learn the server's
+// transfer ID.
+func exchange(ctx context.Context, conn net.PacketConn, toSend []Packet, sendNow bool, rto *retransmitTimer, retries int, success SuccessCriteria, dest net.Addr) (responsePacket Packet, from net.Addr, err error) {
+	// a single buffer, and a single reader: each wait for a response
+	// ends when the read deadline passes, rather than abandoning a
+	// goroutine blocked on the socket
+	buf := make([]byte, MaxPacketSize)
+	// only a response to the first send gives a clean round trip time
+	sampling := sendNow
+	peer := dest
+	if _, ok := toSend[0].(*PacketRequest); ok {
+		peer = nil
+	}
+	for attempt := 0; ; attempt++ {
+		sent := time.Now()
+		if sendNow {
+			for _, p := range toSend {
+				log.Printf("Sending response: %+v\n", p)
+				_, err = conn.WriteTo(p.Serialize(), dest)
+				if err != nil {
+					// if we fail to write, we should exit, as we can't send an error packet
 					return
 				}
 			}
-			// if we've exited the loop, success is true
-			cresult <- received
-		}()
+		}
+		sendNow = true
 
-		select {
-		case err = <-cerror:
-			// do we really want to return the error here, or keep trying?
+		if err = conn.SetReadDeadline(sent.Add(rto.timeout())); err != nil {
 			return
-		case responsePacket = <-cresult:
+		}
+		// checked after setting the deadline, so the deadline set by
+		// watchContext can't have been overwritten
+		if err = cancelled(ctx, conn, dest); err != nil {
+			return nil, nil, err
+		}
+		responsePacket, from, err = awaitResponse(conn, buf, success, dest, peer)
+		if err != nil {
+			if cancelErr := cancelled(ctx, conn, dest); cancelErr != nil {
+				return nil, nil, cancelErr
+			}
+		}
+		if err == nil && sampling {
+			rto.sample(time.Since(sent))
+		}
+		if !isTimeout(err) {
 			return
-		case <-time.After(timeout):
-			// resend
+		}
+		sampling = false
+		rto.backoff()
+		if retries > 0 && attempt >= retries {
+			// the caller will close conn, so the error must be written now
+			writeError(conn, 0, "Timed out", dest)
+			err = &TimeoutError{Retries: retries}
+			return
+		}
+		// resend
+	}
+}
+
+// awaitResponse reads packets into buf until one meets the success
+// criteria, the peer sends an ERROR packet, or the read deadline passes.
+// Only packets from peer are considered, unless it is nil.
+func awaitResponse(conn net.PacketConn, buf []byte, success SuccessCriteria, dest net.Addr, peer net.Addr) (Packet, net.Addr, error) {
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !isTimeout(err) {
+				writeError(conn, 0, err.Error(), dest)
+			}
+			return nil, nil, err
+		}
+		if peer != nil && !sameAddr(addr, peer) {
+			rejectStranger(conn, buf[:n], addr)
 			continue
 		}
+		// trim any trailing bytes
+		received, err := ParsePacket(buf[:n])
+		if err != nil {
+			log.Printf("Received garbage data, still waiting for packet.")
+			writeError(conn, 0, err.Error(), dest)
+			return nil, nil, err
+		}
+		if remote, ok := received.(*PacketError); ok {
+			// the peer has given up, so there's no point replying
+			remote.fromPeer = true
+			return nil, nil, remote
+		}
+		if success(received) {
+			return received, addr, nil
+		}
+	}
+}
+
+// rejectStranger answers a packet from an address other than the peer's
+// with error 5, unless it is an ERROR packet itself, which mustn't be
+// answered, so two strangers can't keep each other busy.
+func rejectStranger(conn net.PacketConn, b []byte, addr net.Addr) {
+	log.Printf("Ignoring packet from %s, which isn't part of the transfer", addr.String())
+	if p, err := ParsePacket(b); err == nil {
+		if _, ok := p.(*PacketError); ok {
+			return
+		}
+	}
+	writeError(conn, 5, "Unknown transfer ID", addr)
+}
+
+// sameAddr reports whether a and b are the same address,
+// and so the same transfer ID.
+func sameAddr(a, b net.Addr) bool {
+	ua, ok := a.(*net.UDPAddr)
+	ub, ok2 := b.(*net.UDPAddr)
+	if ok && ok2 {
+		return ua.IP.Equal(ub.IP) && ua.Port == ub.Port && ua.Zone == ub.Zone
 	}
+	return a.String() == b.String()
 }
 
-func sendError(conn net.PacketConn, code uint16, message string, dest net.Addr) {
-	// sendError should never block
+// cancelled tells the peer the transfer is over if ctx is done, so the
+// caller can stop, and returns the reason.
+func cancelled(ctx context.Context, conn net.PacketConn, dest net.Addr) error {
+	err := ctx.Err()
+	if err != nil {
+		// the caller will close conn, so the error must be written now
+		writeError(conn, 0, "Transfer cancelled", dest)
+	}
+	return err
+}
+
+// watchContext interrupts any read on conn once ctx is done, so the
+// transfer using conn notices promptly.  The returned function stops
+// watching, and must be called when the transfer ends.
+func watchContext(ctx context.Context, conn net.PacketConn) (stop func()) {
+	if ctx.Done() == nil {
+		// ctx can never be cancelled
+		return func() {}
+	}
+	done := make(chan struct{})
 	go func() {
-		p := PacketError{Code: code, Msg: message}
-		conn.WriteTo(p.Serialize(), dest)
+		select {
+		case <-ctx.Done():
+			// a deadline in the past fails any read at once
+			conn.SetReadDeadline(time.Unix(1, 0))
+		case <-done:
+		}
 	}()
+	return func() { close(done) }
+}
+
+// isTimeout reports whether err is a read deadline passing.
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+// writeError sends the peer an ERROR packet, and doesn't return until
+// it has been written, as the caller usually closes conn straight after.
+// A UDP socket never blocks on a write for long, so this is safe.
+func writeError(conn net.PacketConn, code uint16, message string, dest net.Addr) {
+	p := PacketError{Code: code, Msg: message}
+	conn.WriteTo(p.Serialize(), dest)
 }
 
 // OpLogger logs each request and response to it's own destination,
@@ -170,7 +475,10 @@ type PacketConnLogger struct {
 
 func (conn *PacketConnLogger) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
 	n, addr, err = conn.PacketConn.ReadFrom(p)
-	logPacket(p[:n], "Read")
+	if err == nil {
+		// a read that timed out has no packet to show
+		logPacket(p[:n], "Read")
+	}
 	return
 }
 
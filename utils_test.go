@@ -2,19 +2,24 @@ package tftp
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"net"
+	"os"
+	"runtime"
 	"testing"
 	"time"
-
-	"github.com/jordwest/mock-conn"
 )
 
 // PacketEnd and TestPacketConn are mock PacketConn's,
-// based on mock-conn for streaming connections,
-// which uses a pair of pipes to simulate network connections
+// based on net.Pipe for streaming connections, which delivers each
+// write to a single read, and supports deadlines, like a UDP socket.
+// Each datagram carries the address it was sent from, which is Addr,
+// the zero UDPAddr if that is nil, or whatever WriteFrom was given.
 type PacketEnd struct {
-	UnderlyingEnd mock_conn.End
+	UnderlyingEnd net.Conn
+	Addr          *net.UDPAddr
 }
 
 type TestPacketConn struct {
@@ -23,46 +28,77 @@ type TestPacketConn struct {
 }
 
 func NewPacketConn() (result TestPacketConn) {
-	i := mock_conn.NewConn()
-	result.Client = PacketEnd{*i.Client}
-	result.Server = PacketEnd{*i.Server}
+	client, server := net.Pipe()
+	result.Client = PacketEnd{UnderlyingEnd: client}
+	result.Server = PacketEnd{UnderlyingEnd: server}
 	return
 }
 
+// the header of each datagram holds the length of the sender's IP, the
+// IP, and the port
+const maxAddrHeader = 1 + net.IPv6len + 2
+
 func (end *PacketEnd) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
-	n, err = end.UnderlyingEnd.Read(p)
-	if err == nil && n == len(p) {
+	buf := make([]byte, len(p)+maxAddrHeader)
+	if n, err = end.UnderlyingEnd.Read(buf); err != nil {
+		return 0, nil, err
+	}
+	ipLen := int(buf[0])
+	from := &net.UDPAddr{Port: int(binary.BigEndian.Uint16(buf[1+ipLen:]))}
+	if ipLen > 0 {
+		from.IP = net.IP(append([]byte(nil), buf[1:1+ipLen]...))
+	}
+	n = copy(p, buf[1+ipLen+2:n])
+	if n == len(p) {
 		// technically, we might have read right up to the end,
 		// but I'm not sure we can detect that here...
 		err = errors.New("didn't read to end of datagram")
 	}
-	addr = &net.UDPAddr{Port: 69}
-	return
+	return n, from, err
 }
 
 func (end *PacketEnd) WriteTo(p []byte, addr net.Addr) (n int, err error) {
-	return end.UnderlyingEnd.Write(p)
+	return end.WriteFrom(p, end.Addr)
+}
+
+// WriteFrom writes p as though it was sent from the address from,
+// to play the part of a stranger to the transfer
+func (end *PacketEnd) WriteFrom(p []byte, from *net.UDPAddr) (n int, err error) {
+	header := []byte{0}
+	port := make([]byte, 2)
+	if from != nil {
+		header = append([]byte{byte(len(from.IP))}, from.IP...)
+		binary.BigEndian.PutUint16(port, uint16(from.Port))
+	}
+	header = append(header, port...)
+	n, err = end.UnderlyingEnd.Write(append(header, p...))
+	if n -= len(header); n < 0 {
+		n = 0
+	}
+	return n, err
 }
 
-// These functions are not expected to be called
 func (end *PacketEnd) Close() error {
-	return errors.New("Not Implemented")
+	return end.UnderlyingEnd.Close()
 }
 
 func (end *PacketEnd) LocalAddr() net.Addr {
+	if end.Addr != nil {
+		return end.Addr
+	}
 	return &net.UDPAddr{Port: 69}
 }
 
 func (end *PacketEnd) SetDeadline(t time.Time) error {
-	return errors.New("Not Implemented")
+	return end.UnderlyingEnd.SetDeadline(t)
 }
 
 func (end *PacketEnd) SetReadDeadline(t time.Time) error {
-	return errors.New("Not Implemented")
+	return end.UnderlyingEnd.SetReadDeadline(t)
 }
 
 func (end *PacketEnd) SetWriteDeadline(t time.Time) error {
-	return errors.New("Not Implemented")
+	return end.UnderlyingEnd.SetWriteDeadline(t)
 }
 
 // build an array of test data packets
@@ -85,10 +121,17 @@ func generateTestData(numPackets int, endPacketLen int) (value [][]byte) {
 	return
 }
 
+// testSettings returns the default settings, with the given window size
+func testSettings(windowSize int) transferSettings {
+	s := negotiatedSettings(nil)
+	s.windowSize = windowSize
+	return s
+}
+
 func TestSendData(t *testing.T) {
 	value := generateTestData(2, 2)
 	conn := NewPacketConn()
-	go sendData(&conn.Server, value, 10*time.Second, nil)
+	go sendData(context.Background(), &conn.Server, bytes.NewReader(bytes.Join(value, nil)), testSettings(defaultWindowSize), nil)
 	buf := make([]byte, 517)
 	n, _, error := conn.Client.ReadFrom(buf)
 	if error != nil {
@@ -125,6 +168,127 @@ func TestSendData(t *testing.T) {
 	}
 }
 
+func TestSendDataEmptyLastBlock(t *testing.T) {
+	// a file that fills its last block needs an empty block to end it
+	value := bytes.Join(generateTestData(3, 0), nil)
+	conn := NewPacketConn()
+	result := make(chan error)
+	go func() {
+		result <- sendData(context.Background(), &conn.Server, bytes.NewReader(value), testSettings(2), nil)
+	}()
+
+	var received []byte
+	for blockNum := uint16(1); blockNum <= 2; blockNum++ {
+		p := ReadDataPacket(t, &conn.Client)
+		if p.BlockNum != blockNum || len(p.Data) != defaultBlockSize {
+			t.Errorf("Expected full block %d, got block %d of %d bytes", blockNum, p.BlockNum, len(p.Data))
+		}
+		received = append(received, p.Data...)
+	}
+	ack := PacketAck{BlockNum: 2}
+	conn.Client.WriteTo(ack.Serialize(), nil)
+
+	if p := ReadDataPacket(t, &conn.Client); p.BlockNum != 3 || len(p.Data) != 0 {
+		t.Errorf("Expected empty block 3, got block %d of %d bytes", p.BlockNum, len(p.Data))
+	}
+	ack = PacketAck{BlockNum: 3}
+	conn.Client.WriteTo(ack.Serialize(), nil)
+
+	if err := <-result; err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(received, value) {
+		t.Error("Data corruption detected.")
+	}
+}
+
+func ReadDataPacket(t *testing.T, conn net.PacketConn) PacketData {
+	buf := make([]byte, 517)
+	n, _, error := conn.ReadFrom(buf)
+	if error != nil {
+		t.Error(error)
+	}
+	resultPacket := PacketData{}
+	error = resultPacket.Parse(buf[:n])
+	if error != nil {
+		t.Error(error)
+	}
+	return resultPacket
+}
+
+func TestSendDataWindow(t *testing.T) {
+	value := generateTestData(3, 2)
+	conn := NewPacketConn()
+	go sendData(context.Background(), &conn.Server, bytes.NewReader(bytes.Join(value, nil)), testSettings(2), nil)
+
+	// the first window is sent without waiting for acks
+	for _, blockNum := range []uint16{1, 2} {
+		if p := ReadDataPacket(t, &conn.Client); p.BlockNum != blockNum {
+			t.Errorf("Expected block %d, got %d", blockNum, p.BlockNum)
+		}
+	}
+
+	// acking only the first block rolls the window back to the second
+	ack := PacketAck{BlockNum: 1}
+	conn.Client.WriteTo(ack.Serialize(), nil)
+	for _, blockNum := range []uint16{2, 3} {
+		p := ReadDataPacket(t, &conn.Client)
+		if p.BlockNum != blockNum {
+			t.Errorf("Expected block %d, got %d", blockNum, p.BlockNum)
+		}
+		if !bytes.Equal(value[blockNum-1], p.Data) {
+			t.Errorf("Data packet %d corrupt.", blockNum)
+		}
+	}
+}
+
+func TestReceiveDataWindow(t *testing.T) {
+	value := generateTestData(4, 2)
+	conn := NewPacketConn()
+	var resultData bytes.Buffer
+	received := make(chan error)
+	go func() {
+		received <- receiveData(context.Background(), &conn.Server, &PacketAck{BlockNum: 0}, &resultData, testSettings(2), nil)
+	}()
+
+	if p := ReadAckPacket(t, &conn.Client); p.BlockNum != 0 {
+		t.Error("First Ack packet corrupt.")
+	}
+
+	send := func(blockNum uint16) {
+		p := PacketData{BlockNum: blockNum, Data: value[blockNum-1]}
+		if _, err := conn.Client.WriteTo(p.Serialize(), nil); err != nil {
+			t.Error(err)
+		}
+	}
+
+	// only the end of the window is acked
+	send(1)
+	send(2)
+	if p := ReadAckPacket(t, &conn.Client); p.BlockNum != 2 {
+		t.Errorf("Expected ack for end of window, got %d", p.BlockNum)
+	}
+
+	// a gap is acked straight away, with the last block received in order
+	send(4)
+	if p := ReadAckPacket(t, &conn.Client); p.BlockNum != 2 {
+		t.Errorf("Expected ack for last block before gap, got %d", p.BlockNum)
+	}
+
+	send(3)
+	send(4)
+	if p := ReadAckPacket(t, &conn.Client); p.BlockNum != 4 {
+		t.Errorf("Expected final ack, got %d", p.BlockNum)
+	}
+
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resultData.Bytes(), bytes.Join(value, nil)) {
+		t.Error("Data corruption detected.")
+	}
+}
+
 func ReadAckPacket(t *testing.T, conn net.PacketConn) PacketAck {
 	buf := make([]byte, 5)
 	n, _, error := conn.ReadFrom(buf)
@@ -142,9 +306,10 @@ func ReadAckPacket(t *testing.T, conn net.PacketConn) PacketAck {
 func TestReceiveData(t *testing.T) {
 	value := generateTestData(2, 2)
 	conn := NewPacketConn()
-	received := make(chan [][]byte)
+	var resultData bytes.Buffer
+	received := make(chan error)
 	go func() {
-		received <- receiveData(&conn.Server, 10*time.Second, nil)
+		received <- receiveData(context.Background(), &conn.Server, &PacketAck{BlockNum: 0}, &resultData, testSettings(defaultWindowSize), nil)
 	}()
 
 	resultPacket := ReadAckPacket(t, &conn.Client)
@@ -176,11 +341,102 @@ func TestReceiveData(t *testing.T) {
 		t.Error("Third Ack packet corrupt.")
 	}
 
-	resultData := <-received
-	for i := range resultData {
-		if !bytes.Equal(resultData[i], value[i]) {
-			t.Error("Data corruption detected.")
-		}
+	if err := <-received; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(resultData.Bytes(), bytes.Join(value, nil)) {
+		t.Error("Data corruption detected.")
+	}
+}
+
+// failingIO fails every read and write, like a full disk
+type failingIO struct{}
+
+func (failingIO) Read(p []byte) (int, error)  { return 0, errors.New("disk on fire") }
+func (failingIO) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+// readError reads an ERROR packet from conn, failing the test if it
+// doesn't have the code expected
+func readError(t *testing.T, conn net.PacketConn, code uint16) {
+	buf := make([]byte, 517)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, _ := ParsePacket(buf[:n])
+	if e, ok := p.(*PacketError); !ok || e.Code != code {
+		t.Errorf("Expected error %d, got %+v", code, p)
+	}
+}
+
+func TestReceiveDataWriteError(t *testing.T) {
+	conn := NewPacketConn()
+	received := make(chan error)
+	go func() {
+		received <- receiveData(context.Background(), &conn.Server, &PacketAck{BlockNum: 0}, failingIO{}, testSettings(defaultWindowSize), nil)
+	}()
+	ReadAckPacket(t, &conn.Client)
+	p := PacketData{BlockNum: 1, Data: []byte{1, 2, 3}}
+	conn.Client.WriteTo(p.Serialize(), nil)
+	// written before receiveData returns, so closing conn can't lose it
+	readError(t, &conn.Client, 3)
+	if err := <-received; err == nil || err.Error() != "disk full" {
+		t.Errorf("Expected the write error, got %v", err)
+	}
+}
+
+func TestReceiveDataPeerError(t *testing.T) {
+	conn := NewPacketConn()
+	received := make(chan error)
+	go func() {
+		received <- receiveData(context.Background(), &conn.Server, &PacketAck{BlockNum: 0}, &bytes.Buffer{}, testSettings(defaultWindowSize), nil)
+	}()
+	ReadAckPacket(t, &conn.Client)
+	e := PacketError{Code: 0, Msg: "cancelled"}
+	conn.Client.WriteTo(e.Serialize(), nil)
+	// told apart from an error raised by the server itself
+	if err, ok := (<-received).(*PacketError); !ok || err.Msg != "cancelled" || !err.fromPeer {
+		t.Errorf("Expected the peer's error, marked as such, got %+v", err)
+	}
+}
+
+func TestSendDataReadError(t *testing.T) {
+	conn := NewPacketConn()
+	sent := make(chan error)
+	go func() {
+		sent <- sendData(context.Background(), &conn.Server, failingIO{}, testSettings(defaultWindowSize), nil)
+	}()
+	readError(t, &conn.Client, 0)
+	if err := <-sent; err == nil || err.Error() != "disk on fire" {
+		t.Errorf("Expected the read error, got %v", err)
+	}
+}
+
+func TestSendOACK(t *testing.T) {
+	conn := NewPacketConn()
+	options := map[string]string{"blksize": "1024"}
+	result := make(chan error)
+	go func() {
+		result <- sendOACK(context.Background(), &conn.Server, options, testSettings(defaultWindowSize), nil)
+	}()
+
+	buf := make([]byte, 517)
+	n, _, err := conn.Client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oack := PacketOACK{}
+	if err = oack.Parse(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	if oack.Options["blksize"] != "1024" {
+		t.Errorf("OACK corrupt: %+v", oack)
+	}
+
+	ack := PacketAck{BlockNum: 0}
+	conn.Client.WriteTo(ack.Serialize(), nil)
+	if err = <-result; err != nil {
+		t.Error(err)
 	}
 }
 
@@ -206,11 +462,11 @@ func (e *FailOnReadConn) LocalAddr() net.Addr {
 }
 
 func (e *FailOnReadConn) SetDeadline(t time.Time) error {
-	return errors.New("Not Implemented")
+	return nil
 }
 
 func (e *FailOnReadConn) SetReadDeadline(t time.Time) error {
-	return errors.New("Not Implemented")
+	return nil
 }
 
 func (e *FailOnReadConn) SetWriteDeadline(t time.Time) error {
@@ -224,7 +480,7 @@ func TestBadSocketRead(t *testing.T) {
 		return true
 	}
 	requestPacket := PacketAck{BlockNum: 7}
-	resultPacket, err := sendAndWait(&conn, &requestPacket, time.Second, success, &net.UDPAddr{})
+	resultPacket, _, err := sendAndWait(context.Background(), &conn, &requestPacket, fixedTimer(time.Second), 0, success, &net.UDPAddr{})
 	if resultPacket != nil || err == nil {
 		t.Error("Socket read failure did not result in an error")
 	}
@@ -270,7 +526,7 @@ func TestBadSocketWrite(t *testing.T) {
 		return true
 	}
 	requestPacket := PacketAck{BlockNum: 7}
-	resultPacket, err := sendAndWait(&conn, &requestPacket, time.Second, success, &net.UDPAddr{})
+	resultPacket, _, err := sendAndWait(context.Background(), &conn, &requestPacket, fixedTimer(time.Second), 0, success, &net.UDPAddr{})
 	if resultPacket != nil || err == nil {
 		t.Error("Socket write failure did not result in an error")
 	}
@@ -284,7 +540,7 @@ func TestMalformedRead(t *testing.T) {
 	requestPacket := PacketAck{BlockNum: 7}
 	control := make(chan bool)
 	go func() {
-		resultPacket, err := sendAndWait(&conn.Server, &requestPacket, time.Second, success, &net.UDPAddr{})
+		resultPacket, _, err := sendAndWait(context.Background(), &conn.Server, &requestPacket, fixedTimer(time.Second), 0, success, &net.UDPAddr{})
 		if resultPacket != nil || err == nil {
 			t.Error("Socket read malformation did not result in an error")
 		}
@@ -293,18 +549,78 @@ func TestMalformedRead(t *testing.T) {
 	buf := make([]byte, 517)
 	conn.Client.ReadFrom(buf)
 	conn.Client.WriteTo([]byte{1, 2, 3, 4}, &net.UDPAddr{})
+	// the peer is told why the transfer ended
+	n, _, err := conn.Client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := ParsePacket(buf[:n]); p == nil || p.(*PacketError).Code != 0 {
+		t.Errorf("Expected an error packet, got %+v", p)
+	}
 	// don't exit until the goroutine is done
 	<-control
 
 }
 
+func TestUnknownTID(t *testing.T) {
+	conn := NewPacketConn()
+	peer := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	conn.Client.Addr = peer
+	stranger := &net.UDPAddr{IP: net.IPv4(10, 0, 0, 2), Port: 1234}
+	success := func(p Packet) bool {
+		ack, ok := p.(*PacketAck)
+		return ok && ack.BlockNum == 7
+	}
+	requestPacket := PacketData{BlockNum: 7}
+	done := make(chan error)
+	go func() {
+		_, _, err := sendAndWait(context.Background(), &conn.Server, &requestPacket, fixedTimer(time.Second), 0, success, peer)
+		done <- err
+	}()
+	ReadDataPacket(t, &conn.Client)
+
+	// the stranger's ack is answered with error 5, and doesn't end the exchange
+	ack := PacketAck{BlockNum: 7}
+	conn.Client.WriteFrom(ack.Serialize(), stranger)
+	buf := make([]byte, 517)
+	n, _, err := conn.Client.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ParsePacket(buf[:n])
+	if e, ok := p.(*PacketError); !ok || e.Code != 5 {
+		t.Errorf("Expected error 5 for the stranger, got %+v, %v", p, err)
+	}
+
+	// nor do its errors, or its garbage, which is answered too
+	stop := PacketError{Code: 0, Msg: "stop"}
+	conn.Client.WriteFrom(stop.Serialize(), stranger)
+	conn.Client.WriteFrom([]byte{1, 2, 3, 4}, &net.UDPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1235})
+	if n, _, err = conn.Client.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	if p, _ = ParsePacket(buf[:n]); p.(*PacketError).Code != 5 {
+		t.Errorf("Expected error 5 for a stranger on the peer's host, got %+v", p)
+	}
+	select {
+	case err = <-done:
+		t.Fatalf("Expected the exchange to carry on, but it ended with %v", err)
+	default:
+	}
+
+	conn.Client.WriteTo(ack.Serialize(), nil)
+	if err = <-done; err != nil {
+		t.Errorf("Expected the peer's ack to end the exchange, got %v", err)
+	}
+}
+
 func TestTimeOut(t *testing.T) {
 	conn := NewPacketConn()
 	success := func(Packet) bool {
 		return true
 	}
 	requestPacket := PacketAck{BlockNum: 7}
-	go sendAndWait(&conn.Server, &requestPacket, time.Second, success, &net.UDPAddr{})
+	go sendAndWait(context.Background(), &conn.Server, &requestPacket, fixedTimer(time.Second), 0, success, &net.UDPAddr{})
 	buf := make([]byte, 517)
 	conn.Client.ReadFrom(buf)
 	time.Sleep(2 * time.Second)
@@ -318,3 +634,112 @@ func TestTimeOut(t *testing.T) {
 
 // testTimeOutSocket // hard
 // testOpLog // hard-ish
+
+func TestRetryLimit(t *testing.T) {
+	conn := NewPacketConn()
+	success := func(Packet) bool {
+		return true
+	}
+	requestPacket := PacketAck{BlockNum: 7}
+	done := make(chan error)
+	go func() {
+		_, _, err := sendAndWait(context.Background(), &conn.Server, &requestPacket, fixedTimer(10*time.Millisecond), 2, success, &net.UDPAddr{})
+		done <- err
+	}()
+
+	// the packet is sent once, and then resent twice
+	buf := make([]byte, 517)
+	for i := 0; i < 3; i++ {
+		if p := ReadAckPacket(t, &conn.Client); p.BlockNum != 7 {
+			t.Errorf("Expected ack 7 to be resent, got %d", p.BlockNum)
+		}
+	}
+	// before giving up, and telling the peer why
+	n, _, _ := conn.Client.ReadFrom(buf)
+	p := PacketError{}
+	if err := p.Parse(buf[:n]); err != nil || p.Code != 0 {
+		t.Errorf("Expected an error packet, got %v", buf[:n])
+	}
+
+	err := <-done
+	if timeout, ok := err.(*TimeoutError); !ok || timeout.Retries != 2 || !timeout.Timeout() {
+		t.Errorf("Expected a timeout after 2 retries, got %v", err)
+	}
+}
+
+func TestTimeoutsLeakNoGoroutines(t *testing.T) {
+	conn := NewPacketConn()
+	value := generateTestData(3, 10)
+	before := runtime.NumGoroutine()
+
+	done := make(chan error)
+	go func() {
+		s := testSettings(defaultWindowSize)
+		s.rto = fixedTimer(10 * time.Millisecond)
+		done <- sendData(context.Background(), &conn.Server, bytes.NewReader(bytes.Join(value, nil)), s, &net.UDPAddr{})
+	}()
+	for i := range value {
+		// let every block time out twice before acking it
+		for attempt := 0; attempt < 3; attempt++ {
+			if p := ReadDataPacket(t, &conn.Client); int(p.BlockNum) != i+1 {
+				t.Fatalf("Expected block %d, got %d", i+1, p.BlockNum)
+			}
+		}
+		ack := PacketAck{BlockNum: uint16(i + 1)}
+		conn.Client.WriteTo(ack.Serialize(), &net.UDPAddr{})
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// the transfer's goroutine has returned, and nothing else should
+	// be left reading the socket
+	for wait := 0; runtime.NumGoroutine() > before && wait < 100; wait++ {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines leaked by timeouts", after-before)
+	}
+}
+
+func TestSendDataDeadline(t *testing.T) {
+	conn := NewPacketConn()
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error)
+	go func() {
+		// the timeout is long enough that only the deadline can end the transfer
+		s := testSettings(defaultWindowSize)
+		s.rto = fixedTimer(time.Minute)
+		defer watchContext(ctx, &conn.Server)()
+		done <- sendData(ctx, &conn.Server, bytes.NewReader(make([]byte, 2048)), s, &net.UDPAddr{})
+	}()
+
+	ReadDataPacket(t, &conn.Client)
+	buf := make([]byte, 517)
+	n, _, _ := conn.Client.ReadFrom(buf)
+	p := PacketError{}
+	if err := p.Parse(buf[:n]); err != nil || p.Msg != "Transfer cancelled" {
+		t.Errorf("Expected the peer to be told of the cancellation, got %v", buf[:n])
+	}
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to end the transfer, got %v", err)
+	}
+}
+
+func TestPacketConnLoggerReadTimeout(t *testing.T) {
+	var logged bytes.Buffer
+	OpLogger.SetOutput(&logged)
+	defer OpLogger.SetOutput(os.Stderr)
+
+	conn := NewPacketConn()
+	logger := &PacketConnLogger{PacketConn: &conn.Server}
+	logger.SetReadDeadline(time.Now())
+	if _, _, err := logger.ReadFrom(make([]byte, 16)); !isTimeout(err) {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if logged.Len() > 0 {
+		t.Errorf("Expected nothing to be logged for a failed read, got %q", logged.String())
+	}
+}
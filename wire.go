@@ -5,6 +5,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"sort"
+	"strings"
 )
 
 const (
@@ -13,6 +15,7 @@ const (
 	OpData         = 3
 	OpAck          = 4
 	OpError        = 5
+	OpOACK         = 6
 )
 
 // packet is the interface met by all packet structs
@@ -28,6 +31,7 @@ type PacketRequest struct {
 	Op       uint16 // OpRRQ or OpWRQ
 	Filename string
 	Mode     string
+	Options  map[string]string // RFC 2347 options, keyed by lower case name
 }
 
 func (p *PacketRequest) Parse(buf []byte) (err error) {
@@ -40,6 +44,7 @@ func (p *PacketRequest) Parse(buf []byte) (err error) {
 	if p.Mode, buf, err = parseString(buf); err != nil {
 		return err
 	}
+	p.Options = parseRequestOptions(buf)
 	return nil
 }
 
@@ -48,7 +53,7 @@ func (p *PacketRequest) Serialize() []byte {
 	binary.BigEndian.PutUint16(buf, p.Op)
 	copy(buf[2:], p.Filename)
 	copy(buf[2+len(p.Filename)+1:], p.Mode)
-	return buf
+	return append(buf, serializeOptions(p.Options)...)
 }
 
 // PacketData carries a block of data in a file transmission.
@@ -98,6 +103,9 @@ func (p *PacketAck) Serialize() []byte {
 type PacketError struct {
 	Code uint16
 	Msg  string
+	// fromPeer is set on an error received from the other end of a
+	// transfer, rather than one raised to refuse a request
+	fromPeer bool
 }
 
 func (p *PacketError) Parse(buf []byte) (err error) {
@@ -111,6 +119,11 @@ func (p *PacketError) Parse(buf []byte) (err error) {
 	return nil
 }
 
+// Error lets a PacketError received from a peer be returned as an error.
+func (p *PacketError) Error() string {
+	return fmt.Sprintf("error %d from peer: %s", p.Code, p.Msg)
+}
+
 func (p *PacketError) Serialize() []byte {
 	buf := make([]byte, 4+len(p.Msg)+1)
 	binary.BigEndian.PutUint16(buf, OpError)
@@ -119,6 +132,28 @@ func (p *PacketError) Serialize() []byte {
 	return buf
 }
 
+// PacketOACK acknowledges the options of a request (RFC 2347)
+type PacketOACK struct {
+	Options map[string]string
+}
+
+func (p *PacketOACK) Parse(buf []byte) (err error) {
+	buf = buf[2:] // skip over op
+	if p.Options, err = parseOptions(buf); err != nil {
+		return err
+	}
+	if len(p.Options) == 0 {
+		return errors.New("option acknowledgement has no options")
+	}
+	return nil
+}
+
+func (p *PacketOACK) Serialize() []byte {
+	buf := make([]byte, 2)
+	binary.BigEndian.PutUint16(buf, OpOACK)
+	return append(buf, serializeOptions(p.Options)...)
+}
+
 // parseUint16 reads a big-endian uint16 from the beginning of buf,
 // returning it along with a slice pointing at the next position in the buffer.
 func parseUint16(buf []byte) (uint16, []byte, error) {
@@ -138,6 +173,67 @@ func parseString(buf []byte) (string, []byte, error) {
 	return string(buf[:i]), buf[i+1:], nil
 }
 
+// parseOptions reads null-terminated name/value pairs until buf is exhausted.
+// Option names are case insensitive, so they are folded to lower case.
+// A nil map is returned if buf holds no options.
+func parseOptions(buf []byte) (options map[string]string, err error) {
+	for len(buf) > 0 {
+		var name, value string
+		if name, buf, err = parseString(buf); err != nil {
+			return nil, err
+		}
+		if value, buf, err = parseString(buf); err != nil {
+			return nil, err
+		}
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[strings.ToLower(name)] = value
+	}
+	return options, nil
+}
+
+// parseRequestOptions reads the options of a request as parseOptions does,
+// but stops at the first empty or unterminated option instead of failing, as
+// some clients pad their requests, and servers without options ignore
+// anything after the mode.
+func parseRequestOptions(buf []byte) map[string]string {
+	var options map[string]string
+	for len(buf) > 0 {
+		name, rest, err := parseString(buf)
+		if err != nil || name == "" {
+			break
+		}
+		var value string
+		if value, buf, err = parseString(rest); err != nil {
+			break
+		}
+		if options == nil {
+			options = make(map[string]string)
+		}
+		options[strings.ToLower(name)] = value
+	}
+	return options
+}
+
+// serializeOptions writes options as null-terminated name/value pairs.
+// Names are sorted so the wire representation is deterministic.
+func serializeOptions(options map[string]string) []byte {
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf []byte
+	for _, name := range names {
+		buf = append(buf, name...)
+		buf = append(buf, 0)
+		buf = append(buf, options[name]...)
+		buf = append(buf, 0)
+	}
+	return buf
+}
+
 // ParsePacket parses a packet from its wire representation.
 func ParsePacket(buf []byte) (p Packet, err error) {
 	var opcode uint16
@@ -153,6 +249,8 @@ func ParsePacket(buf []byte) (p Packet, err error) {
 		p = &PacketAck{}
 	case OpError:
 		p = &PacketError{}
+	case OpOACK:
+		p = &PacketOACK{}
 	default:
 		err = fmt.Errorf("unexpected opcode %d", opcode)
 		return
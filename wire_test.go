@@ -12,11 +12,15 @@ func TestSerializationDeserialization(t *testing.T) {
 	}{
 		{
 			[]byte("\x00\x01foo\x00bar\x00"),
-			&PacketRequest{OpRRQ, "foo", "bar"},
+			&PacketRequest{OpRRQ, "foo", "bar", nil},
 		},
 		{
 			[]byte("\x00\x02foo\x00bar\x00"),
-			&PacketRequest{OpWRQ, "foo", "bar"},
+			&PacketRequest{OpWRQ, "foo", "bar", nil},
+		},
+		{
+			[]byte("\x00\x01foo\x00bar\x00blksize\x001024\x00tsize\x000\x00"),
+			&PacketRequest{OpRRQ, "foo", "bar", map[string]string{"blksize": "1024", "tsize": "0"}},
 		},
 		{
 			[]byte("\x00\x03\x12\x34fnord"),
@@ -32,7 +36,11 @@ func TestSerializationDeserialization(t *testing.T) {
 		},
 		{
 			[]byte("\x00\x05\xab\xcdparachute failure\x00"),
-			&PacketError{0xabcd, "parachute failure"},
+			&PacketError{Code: 0xabcd, Msg: "parachute failure"},
+		},
+		{
+			[]byte("\x00\x06blksize\x001024\x00"),
+			&PacketOACK{map[string]string{"blksize": "1024"}},
 		},
 	}
 
@@ -58,7 +66,7 @@ func TestDeserializationInvalid(t *testing.T) {
 
 		// invalid opcode
 		[]byte("\x00\x00"),
-		[]byte("\x00\x06"),
+		[]byte("\x00\x07"),
 		[]byte("\xff\x01"),
 		[]byte("\xff\xff"),
 
@@ -87,6 +95,12 @@ func TestDeserializationInvalid(t *testing.T) {
 		[]byte("\x00\x05\xab"),
 		[]byte("\x00\x05\xab\xcd"),
 		[]byte("\x00\x05\xab\xcdparachute failure"),
+
+		// short oack
+		[]byte("\x00\x06"),
+		[]byte("\x00\x06blksize"),
+		[]byte("\x00\x06blksize\x00"),
+		[]byte("\x00\x06blksize\x001024"),
 	}
 
 	for _, test := range tests {
@@ -95,3 +109,39 @@ func TestDeserializationInvalid(t *testing.T) {
 		}
 	}
 }
+
+func TestParseRequestPadding(t *testing.T) {
+	tests := []struct {
+		bytes   []byte
+		options map[string]string
+	}{
+		{[]byte("\x00\x01foo\x00octet\x00\x00"), nil},
+		{[]byte("\x00\x01foo\x00octet\x00\x00\x00\x00\x00"), nil},
+		{[]byte("\x00\x01foo\x00octet\x00junk"), nil},
+		// short options
+		{[]byte("\x00\x01foo\x00octet\x00blksize"), nil},
+		{[]byte("\x00\x01foo\x00octet\x00blksize\x00"), nil},
+		{[]byte("\x00\x01foo\x00octet\x00blksize\x001024"), nil},
+		{[]byte("\x00\x01foo\x00octet\x00blksize\x001024\x00\x00\x00"), map[string]string{"blksize": "1024"}},
+		{[]byte("\x00\x01foo\x00octet\x00blksize\x001024\x00tsize"), map[string]string{"blksize": "1024"}},
+		{[]byte("\x00\x01foo\x00octet\x00blksize\x001024\x00tsize\x000"), map[string]string{"blksize": "1024"}},
+	}
+	for _, test := range tests {
+		p := PacketRequest{}
+		if err := p.Parse(test.bytes); err != nil {
+			t.Errorf("Parsing padded request %q: %v", test.bytes, err)
+		} else if p.Filename != "foo" || p.Mode != "octet" || !reflect.DeepEqual(p.Options, test.options) {
+			t.Errorf("Parsing padded request %q: expected options %v; got %#v", test.bytes, test.options, p)
+		}
+	}
+}
+
+func TestParseOptionCase(t *testing.T) {
+	p := PacketRequest{}
+	if err := p.Parse([]byte("\x00\x01foo\x00octet\x00BlkSize\x001024\x00")); err != nil {
+		t.Fatal(err)
+	}
+	if p.Options["blksize"] != "1024" {
+		t.Errorf("Expected option names to be case insensitive, got %v", p.Options)
+	}
+}